@@ -79,6 +79,8 @@ type SystemConfProvider interface {
 	// Contexts
 	GetTSDBContext() opentsdb.Context
 	GetGraphiteContext() graphite.Context
+	GetGraphiteFailoverContexts() []graphite.Context
+	GetGraphiteConfig() expr.GraphiteConfig
 	GetInfluxContext() client.HTTPConfig
 	GetElasticContext() expr.ElasticHosts
 	GetAzureMonitorContext() expr.AzureMonitorClients
@@ -2,6 +2,7 @@ package conf
 
 import (
 	"bytes"
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"net/http/httputil"
@@ -76,6 +77,9 @@ type SystemConf struct {
 	CommandHookPath string
 	RuleFilePath    string
 	md              toml.MetaData
+	// graphiteState is what the queries of the Graphite of GraphiteConf
+	// remember between checks.
+	graphiteState *expr.GraphiteState
 }
 
 // EnabledBackends stores which query backends supported by bosun are enabled
@@ -118,8 +122,85 @@ type OpenTSDBConf struct {
 // GraphiteConf contains a string representing the host of a graphite server and
 // a map of headers to be sent with each Graphite request
 type GraphiteConf struct {
-	Host    string
-	Headers map[string]string
+	Host string
+	// FailoverHosts are queried in order when Host fails.
+	FailoverHosts []string
+	Headers       map[string]string
+	// Username and Password, if Username is set, are sent to Graphite with
+	// HTTP basic authentication.
+	Username string
+	Password string `json:"-"`
+	// RenderPath and PathPrefix, if set, override the path of the render
+	// endpoint and the prefix of the paths of the other endpoints.
+	RenderPath string
+	PathPrefix string
+	// EmptyResponseTTL is how long a query that returned no series is answered
+	// from memory instead of graphite. Defaults to 30s, 0 disables it.
+	EmptyResponseTTL Duration
+	Retries          int      // Number of retries of a failed query: 0
+	RetryBackoff     Duration // Wait before the first retry, doubled for each further retry: 1s
+	RetryDeadline    Duration // Limit on the total time spent retrying a query, 0 is no limit
+	Timeout          Duration // Time after which a query attempt is cancelled, 0 is no limit
+	BandConcurrency  int      // Number of band windows queried at the same time: 1
+	RateLimit        float64  // Queries per second sent to graphite, 0 is no limit
+	RateBurst        int      // Queries that can be sent at once within RateLimit: 1
+	// CacheMetricsByQuery adds a query tag, the first node of the queried
+	// metric, to the expression cache hit and miss metrics of graphite queries.
+	CacheMetricsByQuery bool
+	// DefaultEndOffset is how far before now graphite queries without an end
+	// duration end, to leave out Graphite's incomplete latest interval.
+	DefaultEndOffset Duration
+	// BandJitter is the most the windows of graphite bands are moved back in
+	// time, so bands of different rules don't all query the same windows.
+	BandJitter Duration
+	// Timezone is the IANA name of the time zone Graphite is asked to use
+	// and calendar boundaries are found in, the local one if empty.
+	Timezone string
+	// MaxSeries is the most series a single graphite query may return, 0 is
+	// no limit.
+	MaxSeries int
+	// CSV requests responses from Graphite as CSV, which is more compact
+	// than the default JSON.
+	CSV bool
+	// StrictTimestamps makes a Graphite series with more than one datapoint
+	// at the same timestamp an error.
+	StrictTimestamps bool
+	// NoneWarnRatio is the share of None datapoints, between 0 and 1, above
+	// which results of graphite queries are marked. 0 disables it.
+	NoneWarnRatio float64
+	// NoNullPoints asks Graphite to leave out None datapoints of queries that
+	// skip them anyway, making responses smaller.
+	NoNullPoints bool
+	// DebugTimings pretty-prints the graphite queries shown in the
+	// expression profiler.
+	DebugTimings bool
+	// CircuitBreakerFailures, if set, is how many graphite queries in a row
+	// may fail before queries fail without being sent to graphite for
+	// CircuitBreakerCooldown, 30s by default.
+	CircuitBreakerFailures int
+	CircuitBreakerCooldown Duration
+	// TimestampsAtBucketEnd moves graphite datapoints to the end of their
+	// interval, like other backends have them, instead of its start.
+	TimestampsAtBucketEnd bool
+	// StrictNodes makes graphite targets with more nodes than their format
+	// an error instead of ignoring the extra nodes.
+	StrictNodes bool
+	// SourceTag, if set, is the name of a tag added to the results of
+	// graphite queries with Source as its value, Host if Source is empty.
+	SourceTag string
+	Source    string
+	// UserAgent, if set, is the User-Agent of graphite queries, and
+	// OriginHeader the name of a header sent with the alert or page that
+	// evaluated the query.
+	UserAgent    string
+	OriginHeader string
+	// BatchWindow, if set, is how long graphite queries wait to be sent
+	// together with other queries, with up to BatchMaxTargets targets, 50
+	// by default.
+	BatchWindow     Duration
+	BatchMaxTargets int
+	// Templates are graphite targets queries can refer to by name.
+	Templates map[string]string
 }
 
 // AnnotateConf contains the elastic configuration to enable Annotations support
@@ -370,6 +451,28 @@ func loadSystemConfig(conf string, isFileName bool) (*SystemConf, error) {
 		return sc, fmt.Errorf("Can't use both ES SimpleClient and ES ClientOptions please remove or disable one in AnnotateConf: %#v", sc.AnnotateConf)
 	}
 
+	if tz := sc.GraphiteConf.Timezone; tz != "" {
+		if _, err := time.LoadLocation(tz); err != nil {
+			return sc, fmt.Errorf("invalid Timezone in GraphiteConf: %v", err)
+		}
+	}
+	for name, path := range map[string]string{"RenderPath": sc.GraphiteConf.RenderPath, "PathPrefix": sc.GraphiteConf.PathPrefix} {
+		if path != "" && !strings.HasPrefix(path, "/") {
+			return sc, fmt.Errorf("invalid %s in GraphiteConf: %q does not start with /", name, path)
+		}
+	}
+	if err := expr.CheckGraphiteTemplates(sc.GraphiteConf.Templates); err != nil {
+		return sc, fmt.Errorf("invalid Templates in GraphiteConf: %v", err)
+	}
+	if tag := sc.GraphiteConf.SourceTag; tag != "" {
+		if !opentsdb.ValidTSDBString(tag) {
+			return sc, fmt.Errorf("invalid SourceTag in GraphiteConf: %q", tag)
+		}
+		if src := sc.GraphiteConf.Source; src != "" && !opentsdb.ValidTSDBString(src) {
+			return sc, fmt.Errorf("invalid Source in GraphiteConf: %q", src)
+		}
+	}
+
 	// Check Azure Monitor Configurations
 	for prefix, conf := range sc.AzureMonitorConf {
 		if err := conf.Valid(); err != nil {
@@ -385,6 +488,7 @@ func loadSystemConfig(conf string, isFileName bool) (*SystemConf, error) {
 	}
 
 	sc.md = decodeMeta
+	sc.graphiteState = expr.NewGraphiteState()
 	// clear default http listen if not explicitly specified
 	if !decodeMeta.IsDefined("HTTPListen") && decodeMeta.IsDefined("HTTPSListen") {
 		sc.HTTPListen = ""
@@ -620,17 +724,109 @@ func (sc *SystemConf) GetGraphiteContext() graphite.Context {
 	if sc.GraphiteConf.Host == "" {
 		return nil
 	}
-	if len(sc.GraphiteConf.Headers) > 0 {
+	return sc.graphiteContext(sc.GraphiteConf.Host)
+}
+
+// GetGraphiteFailoverContexts returns the contexts of FailoverHosts, in
+// order, which are queried when the Graphite of GetGraphiteContext fails.
+func (sc *SystemConf) GetGraphiteFailoverContexts() []graphite.Context {
+	if sc.GraphiteConf.Host == "" {
+		return nil
+	}
+	var contexts []graphite.Context
+	for _, host := range sc.GraphiteConf.FailoverHosts {
+		contexts = append(contexts, sc.graphiteContext(host))
+	}
+	return contexts
+}
+
+// graphiteContext returns the context to query the Graphite at host with the
+// headers, credentials and paths of GraphiteConf.
+func (sc *SystemConf) graphiteContext(host string) graphite.Context {
+	paths := graphite.Paths{
+		Render: sc.GraphiteConf.RenderPath,
+		Prefix: sc.GraphiteConf.PathPrefix,
+	}
+	if len(sc.GraphiteConf.Headers) > 0 || sc.GraphiteConf.Username != "" || paths != (graphite.Paths{}) {
 		headers := http.Header(make(map[string][]string))
 		for k, v := range sc.GraphiteConf.Headers {
 			headers.Add(k, v)
 		}
+		if sc.GraphiteConf.Username != "" {
+			auth := sc.GraphiteConf.Username + ":" + sc.GraphiteConf.Password
+			headers.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+		}
 		return graphite.HostHeader{
-			Host:   sc.GraphiteConf.Host,
+			Host:   host,
 			Header: headers,
+			Paths:  paths,
+		}
+	}
+	return graphite.Host(host)
+}
+
+// GetGraphiteConfig returns the settings used when evaluating graphite queries.
+func (sc *SystemConf) GetGraphiteConfig() expr.GraphiteConfig {
+	c := expr.GraphiteConfig{
+		State:            sc.graphiteState,
+		EmptyResponseTTL: 30 * time.Second,
+		Retries:          sc.GraphiteConf.Retries,
+		RetryBackoff:     time.Second,
+		RetryDeadline:    sc.GraphiteConf.RetryDeadline.Duration,
+		Timeout:          sc.GraphiteConf.Timeout.Duration,
+		BandConcurrency:  1,
+		RateLimit:        sc.GraphiteConf.RateLimit,
+		RateBurst:        sc.GraphiteConf.RateBurst,
+
+		CacheMetricsByQuery: sc.GraphiteConf.CacheMetricsByQuery,
+		DefaultEndOffset:    sc.GraphiteConf.DefaultEndOffset.Duration,
+		BandJitter:          sc.GraphiteConf.BandJitter.Duration,
+		MaxSeries:           sc.GraphiteConf.MaxSeries,
+		CSV:                 sc.GraphiteConf.CSV,
+		StrictTimestamps:    sc.GraphiteConf.StrictTimestamps,
+		NoneWarnRatio:       sc.GraphiteConf.NoneWarnRatio,
+		NoNullPoints:        sc.GraphiteConf.NoNullPoints,
+		DebugTimings:        sc.GraphiteConf.DebugTimings,
+
+		CircuitBreakerFailures: sc.GraphiteConf.CircuitBreakerFailures,
+		CircuitBreakerCooldown: 30 * time.Second,
+		TimestampsAtBucketEnd:  sc.GraphiteConf.TimestampsAtBucketEnd,
+		StrictNodes:            sc.GraphiteConf.StrictNodes,
+		UserAgent:              sc.GraphiteConf.UserAgent,
+		OriginHeader:           sc.GraphiteConf.OriginHeader,
+		BatchWindow:            sc.GraphiteConf.BatchWindow.Duration,
+		BatchMaxTargets:        50,
+		Templates:              sc.GraphiteConf.Templates,
+	}
+	if sc.GraphiteConf.SourceTag != "" {
+		c.SourceTag, c.Source = sc.GraphiteConf.SourceTag, sc.GraphiteConf.Source
+		if c.Source == "" {
+			c.Source = opentsdb.MustReplace(sc.GraphiteConf.Host, "_")
+		}
+		for _, host := range sc.GraphiteConf.FailoverHosts {
+			c.FailoverSources = append(c.FailoverSources, opentsdb.MustReplace(host, "_"))
 		}
 	}
-	return graphite.Host(sc.GraphiteConf.Host)
+	if sc.GraphiteConf.Timezone != "" {
+		// checked when the configuration is loaded
+		c.Location, _ = time.LoadLocation(sc.GraphiteConf.Timezone)
+	}
+	if sc.md.IsDefined("GraphiteConf", "EmptyResponseTTL") {
+		c.EmptyResponseTTL = sc.GraphiteConf.EmptyResponseTTL.Duration
+	}
+	if sc.md.IsDefined("GraphiteConf", "CircuitBreakerCooldown") {
+		c.CircuitBreakerCooldown = sc.GraphiteConf.CircuitBreakerCooldown.Duration
+	}
+	if sc.md.IsDefined("GraphiteConf", "RetryBackoff") {
+		c.RetryBackoff = sc.GraphiteConf.RetryBackoff.Duration
+	}
+	if sc.md.IsDefined("GraphiteConf", "BatchMaxTargets") {
+		c.BatchMaxTargets = sc.GraphiteConf.BatchMaxTargets
+	}
+	if sc.md.IsDefined("GraphiteConf", "BandConcurrency") {
+		c.BandConcurrency = sc.GraphiteConf.BandConcurrency
+	}
+	return c
 }
 
 // GetInfluxContext returns a Influx context which contains all the information needed
@@ -1,9 +1,11 @@
 package conf
 
 import (
+	"net/http"
 	"testing"
 	"time"
 
+	"bosun.org/graphite"
 	"bosun.org/opentsdb"
 
 	"github.com/stretchr/testify/assert"
@@ -64,3 +66,110 @@ func TestSystemToml(t *testing.T) {
 		UnsafeSSL: true,
 	})
 }
+
+func TestGraphiteTimezone(t *testing.T) {
+	if _, err := loadSystemConfig("[GraphiteConf]\nTimezone = \"Not/AZone\"", false); err == nil {
+		t.Error("expected error for unknown time zone")
+	}
+	sc, err := loadSystemConfig("[GraphiteConf]\nTimezone = \"UTC\"", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, sc.GetGraphiteConfig().Location, time.UTC)
+}
+
+func TestGraphiteBandConcurrency(t *testing.T) {
+	sc, err := loadSystemConfig("[GraphiteConf]\nHost = \"localhost:80\"", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, sc.GetGraphiteConfig().BandConcurrency, 1)
+	sc, err = loadSystemConfig("[GraphiteConf]\nHost = \"localhost:80\"\nBandConcurrency = 4", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, sc.GetGraphiteConfig().BandConcurrency, 4)
+}
+
+func TestGraphiteState(t *testing.T) {
+	sc, err := loadSystemConfig("[GraphiteConf]\nHost = \"localhost:80\"", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := sc.GetGraphiteConfig().State; s == nil || s != sc.GetGraphiteConfig().State {
+		t.Error("expected the graphite configs of a system config to share their state")
+	}
+}
+
+func TestGraphiteSourceTag(t *testing.T) {
+	if _, err := loadSystemConfig("[GraphiteConf]\nSourceTag = \"a b\"", false); err == nil {
+		t.Error("expected error for invalid source tag")
+	}
+	sc, err := loadSystemConfig("[GraphiteConf]\nHost = \"graphite-ny:80\"\nFailoverHosts = [\"graphite-sf:80\"]\nSourceTag = \"cluster\"", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := sc.GetGraphiteConfig()
+	assert.Equal(t, c.SourceTag, "cluster")
+	assert.Equal(t, c.Source, "graphite-ny_80")
+	assert.Equal(t, c.FailoverSources, []string{"graphite-sf_80"})
+}
+
+func TestGraphitePaths(t *testing.T) {
+	if _, err := loadSystemConfig("[GraphiteConf]\nRenderPath = \"api/render\"", false); err == nil {
+		t.Error("expected error for a relative render path")
+	}
+	sc, err := loadSystemConfig("[GraphiteConf]\nHost = \"localhost:80\"\nRenderPath = \"/api/render\"\nPathPrefix = \"/api\"", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, ok := sc.GetGraphiteContext().(graphite.HostHeader)
+	if !ok {
+		t.Fatalf("expected a graphite.HostHeader, got %T", sc.GetGraphiteContext())
+	}
+	assert.Equal(t, c.Paths, graphite.Paths{Render: "/api/render", Prefix: "/api"})
+}
+
+func TestGraphiteTemplates(t *testing.T) {
+	if _, err := loadSystemConfig("[GraphiteConf.Templates]\n\"a.b\" = \"x.*\"", false); err == nil {
+		t.Error("expected error for an invalid template name")
+	}
+	sc, err := loadSystemConfig("[GraphiteConf.Templates]\ncpu = \"$host.cpu\"", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, sc.GetGraphiteConfig().Templates, map[string]string{"cpu": "$host.cpu"})
+}
+
+func TestGraphiteFailoverHosts(t *testing.T) {
+	sc, err := loadSystemConfig("[GraphiteConf]\nHost = \"graphite-ny:80\"\nFailoverHosts = [\"graphite-sf:80\", \"graphite-la:80\"]\nUsername = \"bosun\"", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contexts := sc.GetGraphiteFailoverContexts()
+	if len(contexts) != 2 {
+		t.Fatalf("expected 2 failover contexts, got %v", contexts)
+	}
+	c, ok := contexts[1].(graphite.HostHeader)
+	if !ok {
+		t.Fatalf("expected a graphite.HostHeader, got %T", contexts[1])
+	}
+	assert.Equal(t, c.Host, "graphite-la:80")
+	assert.Equal(t, c.Header.Get("Authorization"), sc.GetGraphiteContext().(graphite.HostHeader).Header.Get("Authorization"))
+}
+
+func TestGraphiteBasicAuth(t *testing.T) {
+	sc, err := loadSystemConfig("[GraphiteConf]\nHost = \"localhost:80\"\nUsername = \"bosun\"\nPassword = \"secret\"", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, ok := sc.GetGraphiteContext().(graphite.HostHeader)
+	if !ok {
+		t.Fatalf("expected a graphite.HostHeader, got %T", sc.GetGraphiteContext())
+	}
+	r := http.Request{Header: c.Header}
+	user, password, ok := r.BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, user, "bosun")
+	assert.Equal(t, password, "secret")
+}
@@ -1,6 +1,7 @@
 package expr // import "bosun.org/cmd/bosun/expr"
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"math"
@@ -10,6 +11,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"bosun.org/annotate/backend"
@@ -37,6 +39,9 @@ type State struct {
 	// Origin allows the source of the expression to be identified for logging and debugging
 	Origin string
 
+	// ctx, if not nil, is cancelled when the evaluation is aborted
+	ctx context.Context
+
 	Timer miniprofiler.Timer
 
 	*Backends
@@ -45,7 +50,9 @@ type State struct {
 	*BosunProviders
 
 	// Graphite
-	graphiteQueries []graphite.Request
+	graphiteMu        sync.Mutex // protects the graphite slices from concurrent band windows
+	graphiteQueries   []graphite.Request
+	graphiteResponses []GraphiteResponseSummary
 
 	// OpenTSDB
 	tsdbQueries []opentsdb.Request
@@ -54,11 +61,15 @@ type State struct {
 type Backends struct {
 	TSDBContext     opentsdb.Context
 	GraphiteContext graphite.Context
-	ElasticHosts    ElasticHosts
-	InfluxConfig    client.HTTPConfig
-	ElasticConfig   ElasticConfig
-	AzureMonitor    AzureMonitorClients
-	PromConfig      PromClients
+	// GraphiteFailover are the graphite clusters queried in order when
+	// GraphiteContext fails.
+	GraphiteFailover []graphite.Context
+	GraphiteConfig   GraphiteConfig
+	ElasticHosts     ElasticHosts
+	InfluxConfig     client.HTTPConfig
+	ElasticConfig    ElasticConfig
+	AzureMonitor     AzureMonitorClients
+	PromConfig       PromClients
 }
 
 type BosunProviders struct {
@@ -101,6 +112,12 @@ func New(expr string, funcs ...map[string]parse.Func) (*Expr, error) {
 // Execute applies a parse expression to the specified OpenTSDB context, and
 // returns one result per group. T may be nil to ignore timings.
 func (e *Expr) Execute(backends *Backends, providers *BosunProviders, T miniprofiler.Timer, now time.Time, autods int, unjoinedOk bool, origin string) (r *Results, queries []opentsdb.Request, err error) {
+	return e.ExecuteContext(context.Background(), backends, providers, T, now, autods, unjoinedOk, origin)
+}
+
+// ExecuteContext is like Execute but queries that support it are cancelled
+// when ctx is done.
+func (e *Expr) ExecuteContext(ctx context.Context, backends *Backends, providers *BosunProviders, T miniprofiler.Timer, now time.Time, autods int, unjoinedOk bool, origin string) (r *Results, queries []opentsdb.Request, err error) {
 	if providers.Squelched == nil {
 		providers.Squelched = func(tags opentsdb.TagSet) bool {
 			return false
@@ -112,6 +129,7 @@ func (e *Expr) Execute(backends *Backends, providers *BosunProviders, T miniprof
 		autods:         autods,
 		unjoinedOk:     unjoinedOk,
 		Origin:         origin,
+		ctx:            ctx,
 		Backends:       backends,
 		BosunProviders: providers,
 		Timer:          T,
@@ -119,6 +137,15 @@ func (e *Expr) Execute(backends *Backends, providers *BosunProviders, T miniprof
 	return e.ExecuteState(s)
 }
 
+// Context returns the context of the evaluation, which is done when it is
+// aborted.
+func (e *State) Context() context.Context {
+	if e.ctx == nil {
+		return context.Background()
+	}
+	return e.ctx
+}
+
 func (e *Expr) ExecuteState(s *State) (r *Results, queries []opentsdb.Request, err error) {
 	defer errRecover(&err, s)
 	if s.Timer == nil {
@@ -409,6 +436,20 @@ func (u *Union) ExtendComputations(o *Result) {
 	u.Computations = append(u.Computations, o.Computations...)
 }
 
+// TargetTag is the tag some query functions use to keep the raw name of the
+// series a result came from. It is ignored when joining results.
+const TargetTag = "__target__"
+
+// joinTags returns t without TargetTag.
+func joinTags(t opentsdb.TagSet) opentsdb.TagSet {
+	if _, ok := t[TargetTag]; !ok {
+		return t
+	}
+	t = t.Copy()
+	delete(t, TargetTag)
+	return t
+}
+
 // union returns the combination of a and b where one is a subset of the other.
 func (e *State) union(a, b *Results, expression string) []*Union {
 	const unjoinedGroup = "unjoined group (%v)"
@@ -424,20 +465,26 @@ func (e *State) union(a, b *Results, expression string) []*Union {
 	for _, rb := range b.Results {
 		bm[rb] = true
 	}
+	bGroups := make([]opentsdb.TagSet, len(b.Results))
+	for i, rb := range b.Results {
+		bGroups[i] = joinTags(rb.Group)
+	}
 	var group opentsdb.TagSet
 	for _, ra := range a.Results {
-		for _, rb := range b.Results {
-			if ra.Group.Equal(rb.Group) || len(ra.Group) == 0 || len(rb.Group) == 0 {
+		ga := joinTags(ra.Group)
+		for i, rb := range b.Results {
+			gb := bGroups[i]
+			if ga.Equal(gb) || len(ga) == 0 || len(gb) == 0 {
 				g := ra.Group
-				if len(ra.Group) == 0 {
+				if len(ga) == 0 {
 					g = rb.Group
 				}
 				group = g
-			} else if len(ra.Group) == len(rb.Group) {
+			} else if len(ga) == len(gb) {
 				continue
-			} else if ra.Group.Subset(rb.Group) {
+			} else if ga.Subset(gb) {
 				group = ra.Group
-			} else if rb.Group.Subset(ra.Group) {
+			} else if gb.Subset(ga) {
 				group = rb.Group
 			} else {
 				continue
@@ -837,10 +884,16 @@ func extract(res *Results) interface{} {
 // collectCache is a helper function for collecting metrics on
 // the expression cache
 func collectCacheHit(c *cache.Cache, qType string, hit bool) {
+	collectCacheHitTags(c, qType, hit, nil)
+}
+
+// collectCacheHitTags is like collectCacheHit but adds extra to the tags of
+// the metric.
+func collectCacheHitTags(c *cache.Cache, qType string, hit bool, extra opentsdb.TagSet) {
 	if c == nil {
 		return // if no cache
 	}
-	tags := opentsdb.TagSet{"query_type": qType, "name": c.Name}
+	tags := opentsdb.TagSet{"query_type": qType, "name": c.Name}.Merge(extra)
 	if hit {
 		collect.Add("expr_cache.hit_by_type", tags, 1)
 		return
@@ -1385,11 +1385,15 @@ func Max(e *State, series *Results) (r *Results, err error) {
 // percentile returns the value at the corresponding percentile between 0 and 1.
 // Min and Max can be simulated using p <= 0 and p >= 1, respectively.
 func percentile(dps Series, args ...float64) (a float64) {
-	p := args[0]
 	var x []float64
 	for _, v := range dps {
 		x = append(x, float64(v))
 	}
+	return percentileOf(x, args[0])
+}
+
+// percentileOf is like percentile for the values x, which it sorts.
+func percentileOf(x []float64, p float64) float64 {
 	sort.Float64s(x)
 	if p <= 0 {
 		return x[0]
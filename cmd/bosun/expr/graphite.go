@@ -1,227 +1,4139 @@
 package expr
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"math"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"bosun.org/cmd/bosun/expr/parse"
+	"bosun.org/collect"
 	"bosun.org/graphite"
+	"bosun.org/metadata"
 	"bosun.org/models"
 	"bosun.org/opentsdb"
+	"bosun.org/slog"
 	"github.com/MiniProfiler/go/miniprofiler"
 )
 
 // Graphite defines functions for use with a Graphite backend.
 var Graphite = map[string]parse.Func{
+	"graphiteAbsolute": {
+		Args:   []models.FuncType{models.TypeString, models.TypeScalar, models.TypeScalar, models.TypeString},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteAbsoluteQuery,
+	},
 	"graphiteBand": {
 		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeScalar},
 		Return: models.TypeSeriesSet,
 		Tags:   graphiteTagQuery,
 		F:      GraphiteBand,
 	},
+	"graphiteBandSeconds": {
+		Args:   []models.FuncType{models.TypeString, models.TypeScalar, models.TypeScalar, models.TypeString, models.TypeScalar},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteBandSeconds,
+	},
+	"graphiteBandStats": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeScalar, models.TypeString},
+		Return: models.TypeNumberSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteBandStats,
+	},
+	"graphiteBandCalendar": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeScalar, models.TypeString},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteBandCalendar,
+	},
+	"graphiteBandCalendarTZ": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeScalar, models.TypeString, models.TypeString},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteBandCalendarTZ,
+	},
+	"graphiteBandConsolidate": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeScalar, models.TypeScalar, models.TypeString},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteBandConsolidate,
+	},
+	"graphiteBandZScore": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeScalar, models.TypeString},
+		Return: models.TypeNumberSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteBandZScore,
+	},
+	"graphiteBandSeparate": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeScalar},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteBandSeparateTags,
+		F:      GraphiteBandSeparate,
+	},
+	"graphiteBandPartial": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeScalar, models.TypeScalar},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteBandPartial,
+	},
+	"graphiteBandMDP": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeScalar, models.TypeScalar},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteBandMDP,
+	},
 	"graphite": {
 		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString},
 		Return: models.TypeSeriesSet,
 		Tags:   graphiteTagQuery,
 		F:      GraphiteQuery,
 	},
+	"graphiteCount": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeScalar,
+		F:      GraphiteCount,
+	},
+	"graphiteExists": {
+		Args:   []models.FuncType{models.TypeString},
+		Return: models.TypeScalar,
+		F:      GraphiteExists,
+	},
+	"graphiteIntegral": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeNumberSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteIntegralQuery,
+	},
+	"graphiteLast": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeNumberSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteLastQuery,
+	},
+	"graphiteMulti": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteMultiTagQuery,
+		F:      GraphiteMultiQuery,
+	},
+	"graphiteNaN": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteNaNQuery,
+	},
+	"graphiteNaNTrim": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteNaNTrimQuery,
+	},
+	"graphiteTarget": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteTargetQuery,
+	},
+	"graphitePercentile": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeScalar},
+		Return: models.TypeSeriesSet,
+		Tags:   graphitePercentileTags,
+		F:      GraphitePercentileQuery,
+	},
+	"graphiteTagged": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteTaggedTags,
+		F:      GraphiteTaggedQuery,
+	},
+	"graphiteTemplate": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteTemplateQuery,
+	},
+	"graphiteZero": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteZeroQuery,
+	},
+	"graphiteFromUntil": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteFromUntilQuery,
+	},
+	"graphiteMerge": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteMergeQuery,
+	},
+	"graphiteNoCache": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteNoCacheQuery,
+	},
+	"graphiteRatio": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteRatioTags,
+		F:      GraphiteRatioQuery,
+	},
+	"graphiteRatioSkip": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteRatioTags,
+		F:      GraphiteRatioSkipQuery,
+	},
+	"graphiteSummarize": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteSummarizeQuery,
+	},
+	"graphiteSummarizeXFF": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeScalar},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteSummarizeXFFQuery,
+	},
+	"graphiteFlatline": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeNumberSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteFlatlineQuery,
+	},
+	"graphiteRate": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteRateQuery,
+	},
+	"graphiteInterpolate": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteInterpolateQuery,
+	},
+	"graphitePrimary": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphitePrimaryQuery,
+	},
+	"graphiteNullRatio": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeNumberSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteNullRatioQuery,
+	},
+	"graphiteGaps": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeNumberSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteGapsQuery,
+	},
+	"graphiteConsolidateBy": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteConsolidateByQuery,
+	},
+	"graphiteLastAge": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeNumberSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteLastAgeQuery,
+	},
+	"graphiteFilter": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeScalar},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteFilterQuery,
+	},
+	"graphiteEvents": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteEventsTags,
+		F:      GraphiteEvents,
+	},
+	"graphiteMovingAvg": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteMovingAvgQuery,
+	},
+	"graphiteExpand": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString},
+		Return: models.TypeNumberSet,
+		Tags:   graphiteExpandTags,
+		F:      GraphiteExpand,
+	},
+	"graphiteBestResolution": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeScalar},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteBestResolutionQuery,
+	},
+	"graphiteAllow": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteAllowTags,
+		F:      GraphiteAllowQuery,
+	},
+	"graphiteRaw": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeString,
+		F:      GraphiteRawQuery,
+	},
+	"graphiteArgMax": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeNumberSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteArgMaxQuery,
+	},
+	"graphiteArgMin": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeNumberSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteArgMinQuery,
+	},
+	"graphiteKeyed": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteKeyedTagQuery,
+		F:      GraphiteKeyedQuery,
+	},
+	"graphiteMDP": {
+		Args:   []models.FuncType{models.TypeString, models.TypeString, models.TypeString, models.TypeString, models.TypeScalar},
+		Return: models.TypeSeriesSet,
+		Tags:   graphiteTagQuery,
+		F:      GraphiteMDPQuery,
+	},
 }
 
-func parseGraphiteResponse(req *graphite.Request, s *graphite.Response, formatTags []string) ([]*Result, error) {
-	const parseErrFmt = "graphite ParseError (%s): %s"
-	if len(*s) == 0 {
-		return nil, fmt.Errorf(parseErrFmt, req.URL, "empty response")
+// splitGraphiteTargets splits a list of graphite targets separated by commas
+// or pipes. Separators nested inside function calls, globs or quotes are part
+// of the target and are not split on.
+func splitGraphiteTargets(s string) []string {
+	var targets []string
+	depth := 0
+	var quote rune
+	start := 0
+	add := func(t string) {
+		if t = strings.TrimSpace(t); t != "" {
+			targets = append(targets, t)
+		}
 	}
-	seen := make(map[string]bool)
-	results := make([]*Result, 0)
-	for _, res := range *s {
-		// build tag set
-		tags := make(opentsdb.TagSet)
-		if len(formatTags) == 1 && formatTags[0] == "" {
-			tags["key"] = res.Target
-		} else {
-			nodes := strings.Split(res.Target, ".")
-			if len(nodes) < len(formatTags) {
-				msg := fmt.Sprintf("returned target '%s' does not match format '%s'", res.Target, strings.Join(formatTags, ","))
-				return nil, fmt.Errorf(parseErrFmt, req.URL, msg)
-			}
-			for i, key := range formatTags {
-				if len(key) > 0 {
-					tags[key] = nodes[i]
-				}
+	for i, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
 			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(' || c == '{' || c == '[':
+			depth++
+		case c == ')' || c == '}' || c == ']':
+			depth--
+		case (c == ',' || c == '|') && depth == 0:
+			add(s[start:i])
+			start = i + 1
 		}
-		if !tags.Valid() {
-			msg := fmt.Sprintf("returned target '%s' would make an invalid tag '%s'", res.Target, tags.String())
-			return nil, fmt.Errorf(parseErrFmt, req.URL, msg)
+	}
+	add(s[start:])
+	return targets
+}
+
+// splitGraphiteNodes splits s on dots. A dot escaped with a backslash is part
+// of the node and is unescaped.
+func splitGraphiteNodes(s string) []string {
+	if !strings.Contains(s, `\.`) {
+		return strings.Split(s, ".")
+	}
+	var nodes []string
+	var node []byte
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && s[i+1] == '.':
+			node = append(node, '.')
+			i++
+		case s[i] == '.':
+			nodes = append(nodes, string(node))
+			node = node[:0]
+		default:
+			node = append(node, s[i])
 		}
-		if ts := tags.String(); !seen[ts] {
-			seen[ts] = true
-		} else {
-			return nil, fmt.Errorf(parseErrFmt, req.URL, fmt.Sprintf("More than 1 series identified by tagset '%v'", ts))
+	}
+	return append(nodes, string(node))
+}
+
+// dedupGraphiteTargets removes repeated targets, keeping the first of each.
+// Graphite would return the series of a repeated target twice, which then
+// collide on their tagsets.
+func dedupGraphiteTargets(targets []string) []string {
+	seen := make(map[string]bool, len(targets))
+	deduped := targets[:0]
+	for _, t := range targets {
+		if !seen[t] {
+			seen[t] = true
+			deduped = append(deduped, t)
 		}
-		// build data
-		dps := make(Series)
-		for _, dp := range res.Datapoints {
-			if len(dp) != 2 {
-				return nil, fmt.Errorf(parseErrFmt, req.URL, fmt.Sprintf("Datapoint has != 2 fields: %v", dp))
-			}
-			if len(dp[0].String()) == 0 {
-				// none value. skip this record
-				continue
-			}
-			val, err := dp[0].Float64()
-			if err != nil {
-				msg := fmt.Sprintf("value '%s' cannot be decoded to Float64: %s", dp[0], err.Error())
-				return nil, fmt.Errorf(parseErrFmt, req.URL, msg)
-			}
-			unixTS, err := dp[1].Int64()
-			if err != nil {
-				msg := fmt.Sprintf("timestamp '%s' cannot be decoded to Int64: %s", dp[1], err.Error())
-				return nil, fmt.Errorf(parseErrFmt, req.URL, msg)
+	}
+	return deduped
+}
+
+// graphiteFormat describes how the dot-separated nodes of a target returned
+// by graphite map to tag keys.
+type graphiteFormat struct {
+	text string
+	// keyTag is the tag the whole target is mapped to if text is empty.
+	keyTag string
+	nodes  []graphiteFormatNode
+	// required is the minimum number of nodes a target must have.
+	required int
+	// open is set if the format has **, so targets may have more nodes.
+	open bool
+	// strict makes targets with more nodes than required an error, unless
+	// the format is open.
+	strict bool
+	// candidates, if not empty, are the comma separated formats text is made
+	// of. Each target is parsed with the first of them it matches.
+	candidates []*graphiteFormat
+}
+
+type graphiteFormatNode struct {
+	index int
+	// fromEnd, if not 0, positions the node from the end of the target
+	// instead, 1 being the last node.
+	fromEnd int
+	key     string
+	// transforms are applied in order to the node before it becomes the
+	// value of the tag.
+	transforms []func(string) string
+	// def, if not empty, is the value of the tag when the node is empty.
+	def string
+}
+
+// graphiteFormatTransforms are the transforms that can follow a key of a
+// format, like host:lower.
+var graphiteFormatTransforms = map[string]func(string) string{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trim":  strings.TrimSpace,
+}
+
+// value returns v with the transforms of n applied, or the default of n if v
+// is empty.
+func (n graphiteFormatNode) value(v string) string {
+	if v == "" && n.def != "" {
+		return n.def
+	}
+	for _, t := range n.transforms {
+		v = t(v)
+	}
+	return v
+}
+
+// parseGraphiteTaggedTarget parses the name of a tagged series, as returned
+// by seriesByTag(), like "cpu;host=web01;dc=ny". The metric name is returned
+// as the name tag.
+func parseGraphiteTaggedTarget(target string) (opentsdb.TagSet, bool) {
+	parts := strings.Split(target, ";")
+	if len(parts) < 2 {
+		return nil, false
+	}
+	tags := opentsdb.TagSet{"name": parts[0]}
+	for _, p := range parts[1:] {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, false
+		}
+		tags[kv[0]] = kv[1]
+	}
+	return tags, true
+}
+
+// candidateTags returns the tags of target from the first candidate format
+// that matches it.
+func (f *graphiteFormat) candidateTags(target string) (opentsdb.TagSet, error) {
+	for _, c := range f.candidates {
+		if tags, err := c.tags(target); err == nil {
+			return tags, nil
+		}
+	}
+	nodes := splitGraphiteNodes(target)
+	return nil, fmt.Errorf("returned target '%s' with %d nodes %q matches none of the formats '%s'", target, len(nodes), nodes, f.text)
+}
+
+// taggedTags builds the tag set for a tagged series. The keys of the format
+// name the tags to keep, an empty format keeps all of them.
+func (f *graphiteFormat) taggedTags(target string, tagged opentsdb.TagSet) (opentsdb.TagSet, error) {
+	if len(f.candidates) > 0 {
+		for _, c := range f.candidates {
+			if tags, err := c.taggedTags(target, tagged); err == nil {
+				return tags, nil
 			}
-			t := time.Unix(unixTS, 0)
-			dps[t] = val
 		}
-		results = append(results, &Result{
-			Value: dps,
-			Group: tags,
-		})
+		return nil, fmt.Errorf("returned tagged series '%s' has the tags of none of the formats '%s'", target, f.text)
+	}
+	if f.text == "" {
+		return tagged, nil
 	}
-	return results, nil
+	tags := make(opentsdb.TagSet)
+	for _, n := range f.nodes {
+		v, ok := tagged[n.key]
+		if !ok {
+			return nil, fmt.Errorf("returned tagged series '%s' has no tag '%s' from format '%s'", target, n.key, f.text)
+		}
+		tags[n.key] = n.value(v)
+	}
+	return tags, nil
 }
 
-func GraphiteBand(e *State, query, duration, period, format string, num float64) (r *Results, err error) {
-	r = new(Results)
-	r.IgnoreOtherUnjoined = true
-	r.IgnoreUnjoined = true
-	e.Timer.Step("graphiteBand", func(T miniprofiler.Timer) {
-		var d, p opentsdb.Duration
-		d, err = opentsdb.ParseDuration(duration)
-		if err != nil {
-			return
+// parseGraphiteFormat parses a format string. Each dot-separated entry is
+// either a tag key for the node at the same position, an empty entry or * to
+// skip that node, or index=key to map the node at an explicit zero-based
+// index. A single ** skips any number of nodes, so the entries after it are
+// positioned from the end of the target. A key followed by ?default uses
+// default as the tag value when the node is empty. An empty format maps the
+// whole target to the "key" tag.
+func parseGraphiteFormat(format string) (*graphiteFormat, error) {
+	f := &graphiteFormat{text: format, keyTag: "key"}
+	if format == "" {
+		return f, nil
+	}
+	if strings.Contains(format, ",") {
+		for _, text := range strings.Split(format, ",") {
+			if text == "" {
+				return nil, fmt.Errorf("graphite: empty format in '%s'", format)
+			}
+			c, err := parseGraphiteFormat(text)
+			if err != nil {
+				return nil, err
+			}
+			f.candidates = append(f.candidates, c)
 		}
-		p, err = opentsdb.ParseDuration(period)
-		if err != nil {
-			return
+		return f, nil
+	}
+	entries := splitGraphiteNodes(format)
+	f.required = len(entries)
+	suffix := -1
+	for i, entry := range entries {
+		if entry == "**" {
+			if suffix != -1 {
+				return nil, fmt.Errorf("graphite: more than one ** in format '%s'", format)
+			}
+			suffix = len(entries) - i - 1
+			f.required--
+			f.open = true
+			continue
 		}
-		if num < 1 || num > 100 {
-			err = fmt.Errorf("expr: Band: num out of bounds")
+		if entry == "*" {
+			continue
 		}
-		req := &graphite.Request{
-			Targets: []string{query},
+		node := graphiteFormatNode{index: i, key: entry}
+		if suffix != -1 {
+			node = graphiteFormatNode{fromEnd: len(entries) - i, key: entry}
 		}
-		now := e.now
-		req.End = &now
-		st := e.now.Add(-time.Duration(d))
-		req.Start = &st
-		for i := 0; i < int(num); i++ {
-			now = now.Add(time.Duration(-p))
-			req.End = &now
-			st := now.Add(time.Duration(-d))
-			req.Start = &st
-			var s graphite.Response
-			s, err = timeGraphiteRequest(e, req)
-			if err != nil {
-				return
+		if eq := strings.Index(entry, "="); eq != -1 {
+			if suffix != -1 {
+				return nil, fmt.Errorf("graphite: node index '%s' after ** in format '%s'", entry[:eq], format)
 			}
-			formatTags := strings.Split(format, ".")
-			var results []*Result
-			results, err = parseGraphiteResponse(req, &s, formatTags)
-			if err != nil {
-				return
+			idx, err := strconv.Atoi(entry[:eq])
+			if err != nil || idx < 0 {
+				return nil, fmt.Errorf("graphite: invalid node index '%s' in format '%s'", entry[:eq], format)
 			}
-			if i == 0 {
-				r.Results = results
-			} else {
-				// different graphite requests might return series with different id's.
-				// i.e. a different set of tagsets.  merge the data of corresponding tagsets
-				for _, result := range results {
-					updateKey := -1
-					for j, existing := range r.Results {
-						if result.Group.Equal(existing.Group) {
-							updateKey = j
-							break
-						}
-					}
-					if updateKey == -1 {
-						// result tagset is new
-						r.Results = append(r.Results, result)
-						updateKey = len(r.Results) - 1
-					}
-					for k, v := range result.Value.(Series) {
-						r.Results[updateKey].Value.(Series)[k] = v
-					}
+			node = graphiteFormatNode{index: idx, key: entry[eq+1:]}
+			if idx >= f.required {
+				f.required = idx + 1
+			}
+		}
+		if q := strings.Index(node.key, "?"); q != -1 {
+			node.def = node.key[q+1:]
+			if !opentsdb.ValidTSDBString(node.def) {
+				return nil, fmt.Errorf("graphite: invalid default '%s' in format '%s'", node.def, format)
+			}
+			node.key = node.key[:q]
+		}
+		if c := strings.Index(node.key, ":"); c != -1 {
+			for _, name := range strings.Split(node.key[c+1:], ":") {
+				t, ok := graphiteFormatTransforms[name]
+				if !ok {
+					return nil, fmt.Errorf("graphite: unknown transform '%s' in format '%s'", name, format)
 				}
+				node.transforms = append(node.transforms, t)
 			}
+			node.key = node.key[:c]
+		}
+		if node.key != "" {
+			f.nodes = append(f.nodes, node)
 		}
-	})
-	if err != nil {
-		return nil, fmt.Errorf("graphiteBand: %v", err)
 	}
-	return
+	return f, nil
 }
 
-func GraphiteQuery(e *State, query string, sduration, eduration, format string) (r *Results, err error) {
-	sd, err := opentsdb.ParseDuration(sduration)
-	if err != nil {
-		return
+// keys returns the tag keys of f. For candidate formats they are the keys of
+// all candidates.
+func (f *graphiteFormat) keys() []string {
+	keys := make([]string, 0, len(f.nodes))
+	for _, n := range f.nodes {
+		keys = append(keys, n.key)
 	}
-	ed := opentsdb.Duration(0)
-	if eduration != "" {
-		ed, err = opentsdb.ParseDuration(eduration)
-		if err != nil {
-			return
+	seen := make(map[string]bool)
+	for _, c := range f.candidates {
+		for _, k := range c.keys() {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
 		}
 	}
-	st := e.now.Add(-time.Duration(sd))
-	et := e.now.Add(-time.Duration(ed))
-	req := &graphite.Request{
-		Targets: []string{query},
-		Start:   &st,
-		End:     &et,
+	return keys
+}
+
+// tags builds the tag set for target.
+func (f *graphiteFormat) tags(target string) (opentsdb.TagSet, error) {
+	if len(f.candidates) > 0 {
+		return f.candidateTags(target)
 	}
-	s, err := timeGraphiteRequest(e, req)
-	if err != nil {
-		return nil, err
+	tags := make(opentsdb.TagSet)
+	if f.text == "" {
+		tags[f.keyTag] = target
+		return tags, nil
 	}
-	formatTags := strings.Split(format, ".")
-	r = new(Results)
-	results, err := parseGraphiteResponse(req, &s, formatTags)
-	if err != nil {
-		return nil, err
+	nodes := splitGraphiteNodes(target)
+	if len(nodes) < f.required {
+		return nil, fmt.Errorf("returned target '%s' does not match format '%s': target has %d nodes %q but format requires %d", target, f.text, len(nodes), nodes, f.required)
 	}
-	r.Results = results
-
-	return
+	if f.strict && !f.open && len(nodes) > f.required {
+		return nil, fmt.Errorf("returned target '%s' does not match format '%s': target has %d nodes %q but format has %d", target, f.text, len(nodes), nodes, f.required)
+	}
+	for _, n := range f.nodes {
+		if n.fromEnd != 0 {
+			tags[n.key] = n.value(nodes[len(nodes)-n.fromEnd])
+			continue
+		}
+		tags[n.key] = n.value(nodes[n.index])
+	}
+	return tags, nil
 }
 
-func graphiteTagQuery(args []parse.Node) (parse.Tags, error) {
-	t := make(parse.Tags)
-	n := args[3].(*parse.StringNode)
-	for _, s := range strings.Split(n.Text, ".") {
-		if s != "" {
-			t[s] = struct{}{}
-		}
+// setStrict makes f and its candidates strict.
+func (f *graphiteFormat) setStrict() {
+	f.strict = true
+	for _, c := range f.candidates {
+		c.setStrict()
 	}
-	return t, nil
 }
 
-func timeGraphiteRequest(e *State, req *graphite.Request) (resp graphite.Response, err error) {
-	e.graphiteQueries = append(e.graphiteQueries, *req)
-	b, _ := json.MarshalIndent(req, "", "  ")
-	e.Timer.StepCustomTiming("graphite", "query", string(b), func() {
-		key := req.CacheKey()
-		getFn := func() (interface{}, error) {
-			return e.GraphiteContext.Query(req)
+// graphiteParseOptions changes how graphiteFetch queries graphite and how
+// parseGraphiteResponse builds results. The zero value gives the default
+// behaviour of the graphite function.
+type graphiteParseOptions struct {
+	// none selects what happens to datapoints graphite returned as None.
+	none graphiteNoneMode
+	// merge, if not nil, combines the datapoints of series that have the same
+	// tagset instead of returning an error.
+	merge func(a, b float64) float64
+	// nativeTags uses the tags graphite returned with a series instead of
+	// the format, for the series that have any. Series named like the ones
+	// of seriesByTag() have the tags of their name picked by the format.
+	nativeTags bool
+	// targetTag adds the raw target of each series as TargetTag.
+	targetTag bool
+	// targetFormats, if not nil, picks the format of each series instead of
+	// using the same for all.
+	targetFormats *graphiteTargetFormats
+	// noCache bypasses the cache so graphite is always queried.
+	noCache bool
+	// counts, if not nil, is called with the number of None datapoints and
+	// of all datapoints graphite returned for each result, before any are
+	// dropped or merged by timestamp.
+	counts func(res *Result, nones, total int)
+	// noFailover only queries the primary graphite, for data the failover
+	// clusters don't have.
+	noFailover bool
+	// strictTimestamps returns an error for series with more than one
+	// datapoint at the same timestamp instead of keeping the last.
+	strictTimestamps bool
+	// sourceTag, if set, is added to every series with source as its value.
+	sourceTag, source string
+	// cluster is the graphite that answered, as returned by queryGraphite.
+	cluster int
+	// bucketEnd moves every datapoint forward by the step of its series, so
+	// it is at the end of the bucket graphite consolidated it into.
+	bucketEnd bool
+	// strictNodes makes targets with more nodes than their format has an
+	// error instead of ignoring the extra nodes.
+	strictNodes bool
+	// allow, if not nil, has a regular expression for tag keys whose values
+	// must match it. Series with other values are an error, or dropped if
+	// dropDisallowed is set.
+	allow          map[string]*regexp.Regexp
+	dropDisallowed bool
+}
+
+// graphiteMergeFuncs are the ways datapoints with the same timestamp can be
+// combined when series with the same tagset are merged.
+var graphiteMergeFuncs = map[string]func(a, b float64) float64{
+	"sum":  func(a, b float64) float64 { return a + b },
+	"max":  math.Max,
+	"min":  math.Min,
+	"last": func(a, b float64) float64 { return b },
+}
+
+type graphiteNoneMode int
+
+const (
+	// graphiteNoneSkip drops None datapoints from the series.
+	graphiteNoneSkip graphiteNoneMode = iota
+	// graphiteNoneNaN stores None datapoints as NaN.
+	graphiteNoneNaN
+	// graphiteNoneLeading drops the None datapoints before the first value of
+	// a series, like the ones derivative() returns, and stores the rest as NaN.
+	graphiteNoneLeading
+	// graphiteNoneZero stores None datapoints as 0.
+	graphiteNoneZero
+)
+
+// graphiteParseErrFmt formats parse errors with the targets of the request,
+// its URL and the message.
+const graphiteParseErrFmt = "graphite ParseError for %s (%s): %s"
+
+// graphiteParser builds results from the series of a graphite response one
+// series at a time.
+type graphiteParser struct {
+	req     *graphite.Request
+	format  *graphiteFormat
+	opts    graphiteParseOptions
+	seen    map[string]*Result
+	results []*Result
+	series  int
+	// nones counts the None datapoints, the imprecise ones and all
+	// datapoints of each result.
+	nones map[*Result]*graphiteNoneCount
+}
+
+type graphiteNoneCount struct {
+	nones, imprecise, total int
+}
+
+// graphiteConfigOptions returns opts with the options GraphiteConfig sets
+// for all queries, for a response of cluster as returned by queryGraphite.
+func graphiteConfigOptions(e *State, cluster int, opts graphiteParseOptions) graphiteParseOptions {
+	c := e.GraphiteConfig
+	opts.strictTimestamps = c.StrictTimestamps
+	opts.sourceTag, opts.source = c.SourceTag, graphiteSource(c, cluster)
+	opts.cluster = cluster
+	opts.bucketEnd = c.TimestampsAtBucketEnd
+	opts.strictNodes = c.StrictNodes
+	return opts
+}
+
+func newGraphiteParser(req *graphite.Request, format *graphiteFormat, opts graphiteParseOptions) *graphiteParser {
+	if opts.strictNodes {
+		if format != nil {
+			format.setStrict()
+		}
+		if opts.targetFormats != nil {
+			for _, tf := range opts.targetFormats.formats {
+				tf.f.setStrict()
+			}
+		}
+	}
+	return &graphiteParser{
+		req:     req,
+		format:  format,
+		opts:    opts,
+		seen:    make(map[string]*Result),
+		results: make([]*Result, 0),
+		nones:   make(map[*Result]*graphiteNoneCount),
+	}
+}
+
+func parseGraphiteResponse(req *graphite.Request, s *graphite.Response, format *graphiteFormat, opts graphiteParseOptions) ([]*Result, error) {
+	p := newGraphiteParser(req, format, opts)
+	for i := range *s {
+		if err := p.add(&(*s)[i]); err != nil {
+			return nil, err
+		}
+	}
+	return p.done()
+}
+
+// NoDataError is returned by graphite queries whose response has no series,
+// so callers can tell missing data apart from failed queries. Cluster is the
+// failover cluster that answered, or 0 for the primary graphite.
+type NoDataError struct {
+	Targets []string
+	URL     *url.URL
+	Cluster int
+}
+
+func (err *NoDataError) Error() string {
+	if err.Cluster > 0 {
+		return fmt.Sprintf(graphiteParseErrFmt, strings.Join(err.Targets, ", "), err.URL, fmt.Sprintf("empty response from failover cluster %d after the primary graphite failed", err.Cluster))
+	}
+	return fmt.Sprintf(graphiteParseErrFmt, strings.Join(err.Targets, ", "), err.URL, "empty response")
+}
+
+// IsNoData reports whether err is a NoDataError of the primary graphite,
+// which has no series for the query. An empty response of a failover cluster
+// isn't, since the primary failed and may well have the data.
+func IsNoData(err error) bool {
+	nd, ok := err.(*NoDataError)
+	return ok && nd.Cluster == 0
+}
+
+// error returns a parse error with msg for the request of p.
+func (p *graphiteParser) error(msg string) error {
+	return fmt.Errorf(graphiteParseErrFmt, strings.Join(p.req.Targets, ", "), p.req.URL, msg)
+}
+
+// add parses the series res.
+func (p *graphiteParser) add(res *graphite.Series) error {
+	p.series++
+	// build tag set
+	var tags opentsdb.TagSet
+	var err error
+	if p.opts.nativeTags && len(res.Tags) > 0 {
+		tags = make(opentsdb.TagSet, len(res.Tags))
+		for k, v := range res.Tags {
+			tags[k] = v
+		}
+	} else {
+		f := p.format
+		if p.opts.targetFormats != nil {
+			if f, err = p.opts.targetFormats.format(res.Target); err != nil {
+				return p.error(err.Error())
+			}
+		}
+		if tagged, ok := parseGraphiteTaggedTarget(res.Target); ok && p.opts.nativeTags {
+			tags, err = f.taggedTags(res.Target, tagged)
+		} else {
+			tags, err = f.tags(res.Target)
+		}
+		if err != nil {
+			return p.error(err.Error())
+		}
+	}
+	if !tags.Valid() {
+		msg := fmt.Sprintf("returned target '%s' would make an invalid tag '%s'", res.Target, tags.String())
+		return p.error(msg)
+	}
+	for k, re := range p.opts.allow {
+		if v, ok := tags[k]; ok && !re.MatchString(v) {
+			if p.opts.dropDisallowed {
+				return nil
+			}
+			return p.error(fmt.Sprintf("returned target '%s' has %s=%s, which is not allowed by %s", res.Target, k, v, re))
+		}
+	}
+	if p.opts.targetTag {
+		tags[TargetTag] = opentsdb.MustReplace(res.Target, "_")
+	}
+	if p.opts.sourceTag != "" {
+		tags[p.opts.sourceTag] = p.opts.source
+	}
+	ts := tags.String()
+	existing := p.seen[ts]
+	if existing != nil && p.opts.merge == nil {
+		return p.error(fmt.Sprintf("More than 1 series identified by tagset '%v'", ts))
+	}
+	// build data
+	var shift time.Duration
+	if p.opts.bucketEnd {
+		shift = graphiteDatapointStep(res.Datapoints)
+	}
+	dps := make(Series)
+	leading := true
+	count := graphiteNoneCount{total: len(res.Datapoints)}
+	for i, dp := range res.Datapoints {
+		if len(dp) != 2 {
+			return p.error(fmt.Sprintf("Datapoint has != 2 fields: %v", dp))
+		}
+		if len(dp[0].String()) == 0 {
+			count.nones++
+			if p.opts.none == graphiteNoneSkip || (p.opts.none == graphiteNoneLeading && leading) {
+				// none value. skip this record
+				continue
+			}
+		} else {
+			leading = false
+		}
+		val := math.NaN()
+		if p.opts.none == graphiteNoneZero {
+			val = 0
+		}
+		if len(dp[0].String()) != 0 {
+			val, err = graphiteValue(dp[0])
+			if err != nil {
+				msg := fmt.Sprintf("value '%s' of datapoint %d (timestamp %s) of target '%s' cannot be decoded to Float64: %s", dp[0], i, dp[1], res.Target, err.Error())
+				return p.error(msg)
+			}
+			if graphiteImprecise(dp[0], val) {
+				count.imprecise++
+			}
+		}
+		unixTS, err := graphiteTimestamp(dp[1])
+		if err != nil {
+			msg := fmt.Sprintf("timestamp '%s' of datapoint %d of target '%s' cannot be decoded to Int64: %s", dp[1], i, res.Target, err.Error())
+			return p.error(msg)
+		}
+		t := time.Unix(unixTS, 0).Add(shift)
+		if _, ok := dps[t]; ok && p.opts.strictTimestamps {
+			msg := fmt.Sprintf("target '%s' has more than one datapoint at timestamp %d", res.Target, unixTS)
+			return p.error(msg)
+		}
+		dps[t] = val
+	}
+	if existing != nil {
+		merged := existing.Value.(Series)
+		for t, v := range dps {
+			if old, ok := merged[t]; ok {
+				v = p.opts.merge(old, v)
+			}
+			merged[t] = v
+		}
+		p.nones[existing].nones += count.nones
+		p.nones[existing].imprecise += count.imprecise
+		p.nones[existing].total += count.total
+		return nil
+	}
+	result := &Result{
+		Value: dps,
+		Group: tags,
+	}
+	p.seen[ts] = result
+	p.results = append(p.results, result)
+	p.nones[result] = &count
+	return nil
+}
+
+// graphiteDatapointStep returns the smallest interval between consecutive
+// datapoints, which is the step of the series even if graphite left out
+// some None datapoints. It is 0 for series with fewer than two datapoints.
+func graphiteDatapointStep(dps []graphite.DataPoint) time.Duration {
+	var step int64
+	prev := int64(math.MinInt64)
+	for _, dp := range dps {
+		if len(dp) != 2 {
+			continue
+		}
+		ts, err := graphiteTimestamp(dp[1])
+		if err != nil {
+			continue
+		}
+		if d := ts - prev; prev != math.MinInt64 && d > 0 && (step == 0 || d < step) {
+			step = d
+		}
+		prev = ts
+	}
+	return time.Duration(step) * time.Second
+}
+
+// graphiteValue parses the value of a datapoint. Values too large for a
+// float64, like 1e400, are returned as infinities instead of an error.
+func graphiteValue(n json.Number) (float64, error) {
+	v, err := strconv.ParseFloat(string(n), 64)
+	if ne, ok := err.(*strconv.NumError); ok && ne.Err == strconv.ErrRange {
+		return v, nil
+	}
+	return v, err
+}
+
+// graphiteMaxExactInt is the integer below which all integers are exact in
+// a float64.
+const graphiteMaxExactInt = 1 << 53
+
+// graphiteImprecise reports if n is an integer, such as a large counter,
+// that changed when it was decoded to v.
+func graphiteImprecise(n json.Number, v float64) bool {
+	if math.Abs(v) < graphiteMaxExactInt {
+		return false
+	}
+	i, ok := new(big.Int).SetString(string(n), 10)
+	if !ok {
+		return false
+	}
+	if math.IsInf(v, 0) {
+		return true
+	}
+	exact, _ := new(big.Float).SetFloat64(v).Int(nil)
+	return exact.Cmp(i) != 0
+}
+
+// graphiteTimestamp parses the timestamp of a datapoint, which some graphite
+// backends write in float notation, like 1.5e9 or 1500000000.0.
+func graphiteTimestamp(n json.Number) (int64, error) {
+	if ts, err := n.Int64(); err == nil {
+		return ts, nil
+	}
+	f, err := strconv.ParseFloat(string(n), 64)
+	if err != nil {
+		return 0, err
+	}
+	if f != math.Trunc(f) || math.Abs(f) > math.MaxInt64 {
+		return 0, fmt.Errorf("%s is not a whole number of seconds", n)
+	}
+	return int64(f), nil
+}
+
+// done returns the results of all series added.
+func (p *graphiteParser) done() ([]*Result, error) {
+	if p.series == 0 {
+		return nil, &NoDataError{Targets: p.req.Targets, URL: p.req.URL, Cluster: p.opts.cluster}
+	}
+	// graphite doesn't return series in a stable order, so sort them to
+	// keep results and everything built from them the same between runs.
+	sort.Sort(ResultSliceByGroup(p.results))
+	return p.results, nil
+}
+
+func GraphiteBand(e *State, query, duration, period, format string, num float64) (r *Results, err error) {
+	return graphiteBand(e, query, duration, period, format, num, graphiteBandOptions{})
+}
+
+// graphiteBandMaxSeconds is the longest duration and period of
+// GraphiteBandSeconds, a year, so the 100 periods of the oldest window still
+// fit in a time.Duration.
+const graphiteBandMaxSeconds = 365 * 24 * 3600
+
+// GraphiteBandSeconds is like GraphiteBand but duration and period are
+// numbers of seconds, so they can be computed by other expressions.
+func GraphiteBandSeconds(e *State, query string, duration, period float64, format string, num float64) (r *Results, err error) {
+	for _, arg := range []struct {
+		name    string
+		seconds float64
+	}{{"duration", duration}, {"period", period}} {
+		// NaN fails both comparisons
+		if !(arg.seconds > 0 && arg.seconds <= graphiteBandMaxSeconds) {
+			return nil, fmt.Errorf("graphiteBandSeconds: %s must be more than 0 and at most %d seconds, got %v", arg.name, graphiteBandMaxSeconds, arg.seconds)
+		}
+	}
+	d := opentsdb.Duration(duration * float64(time.Second))
+	p := opentsdb.Duration(period * float64(time.Second))
+	return graphiteBandDurations(e, query, d, p, format, num, graphiteBandOptions{})
+}
+
+// graphiteBandStatFuncs are the statistics GraphiteBandStats can return.
+var graphiteBandStatFuncs = map[string]func(Series, ...float64) float64{
+	"avg": avg,
+	"dev": dev,
+}
+
+// GraphiteBandStats is like GraphiteBand but reduces the datapoints of all
+// windows of each result with stat, avg or dev.
+func GraphiteBandStats(e *State, query, duration, period, format string, num float64, stat string) (r *Results, err error) {
+	f, ok := graphiteBandStatFuncs[stat]
+	if !ok {
+		return nil, fmt.Errorf("graphiteBandStats: stat must be avg or dev, got %q", stat)
+	}
+	r, err = graphiteBand(e, query, duration, period, format, num, graphiteBandOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return reduce(e, r, f)
+}
+
+// GraphiteBandCalendar is like GraphiteBand but the start of every window is
+// moved back to the start of the hour, day or week it is in, as named by
+// anchor, so the windows line up with the calendar whenever the rule runs.
+func GraphiteBandCalendar(e *State, query, duration, period, format string, num float64, anchor string) (r *Results, err error) {
+	return graphiteBandCalendar(e, query, duration, period, format, num, anchor, e.GraphiteConfig.Location)
+}
+
+// GraphiteBandCalendarTZ is like GraphiteBandCalendar but the boundaries are
+// found in the time zone with the IANA name tz, such as "Europe/Berlin".
+func GraphiteBandCalendarTZ(e *State, query, duration, period, format string, num float64, anchor, tz string) (r *Results, err error) {
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return nil, fmt.Errorf("graphiteBandCalendarTZ: %v", err)
+	}
+	return graphiteBandCalendar(e, query, duration, period, format, num, anchor, loc)
+}
+
+func graphiteBandCalendar(e *State, query, duration, period, format string, num float64, anchor string, loc *time.Location) (r *Results, err error) {
+	switch anchor {
+	case "hour", "day", "week":
+	default:
+		return nil, fmt.Errorf("graphiteBandCalendar: anchor must be hour, day or week, not '%s'", anchor)
+	}
+	return graphiteBand(e, query, duration, period, format, num, graphiteBandOptions{anchor: anchor, loc: loc})
+}
+
+// graphiteBandJitter returns how far the windows of a band of query are moved
+// back in time, so that bands of different rules don't all query graphite for
+// the same windows at the same time. It is the same every time a rule is run.
+func graphiteBandJitter(e *State, query string) time.Duration {
+	max := uint64(e.GraphiteConfig.BandJitter / time.Second)
+	if max == 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(e.Origin))
+	h.Write([]byte{0})
+	h.Write([]byte(query))
+	return time.Duration(h.Sum64()%max) * time.Second
+}
+
+// GraphiteBandMDP is like GraphiteBand but graphite consolidates each window
+// to at most maxDataPoints datapoints, and the timestamps are aligned to the
+// resulting bucket boundaries so that the windows line up when merged.
+func GraphiteBandMDP(e *State, query, duration, period, format string, num, maxDataPoints float64) (r *Results, err error) {
+	if maxDataPoints < 1 {
+		return nil, fmt.Errorf("graphiteBandMDP: maxDataPoints must be at least 1")
+	}
+	return graphiteBand(e, query, duration, period, format, num, graphiteBandOptions{maxDataPoints: int(maxDataPoints)})
+}
+
+// GraphiteBandConsolidate is like GraphiteBandMDP but datapoints of different
+// windows that end up with the same timestamp are combined with the named
+// function (avg, sum, max, min or last) instead of the last one winning. A
+// maxDataPoints of 0 leaves the resolution to graphite.
+func GraphiteBandConsolidate(e *State, query, duration, period, format string, num, maxDataPoints float64, consolidateBy string) (r *Results, err error) {
+	if maxDataPoints < 0 {
+		return nil, fmt.Errorf("graphiteBandConsolidate: maxDataPoints must not be negative")
+	}
+	if _, ok := graphiteMergeFuncs[consolidateBy]; !ok && consolidateBy != "avg" {
+		return nil, fmt.Errorf("graphiteBandConsolidate: unknown consolidation function '%s'", consolidateBy)
+	}
+	opts := graphiteBandOptions{
+		maxDataPoints: int(maxDataPoints),
+		consolidateBy: consolidateBy,
+	}
+	return graphiteBand(e, query, duration, period, format, num, opts)
+}
+
+// GraphiteBandPartial is like GraphiteBand but up to maxFailures windows may
+// fail. The band is built from the other windows and every result records how
+// many windows were dropped.
+func GraphiteBandPartial(e *State, query, duration, period, format string, num, maxFailures float64) (r *Results, err error) {
+	if maxFailures < 0 {
+		return nil, fmt.Errorf("graphiteBandPartial: maxFailures must not be negative")
+	}
+	return graphiteBand(e, query, duration, period, format, num, graphiteBandOptions{maxFailures: int(maxFailures)})
+}
+
+// GraphiteBandZScore returns for each result of the band of query how many
+// standard deviations the average of the last duration is from the average
+// of the band. zeroVariance is what is returned if the band has no variance
+// and the averages differ: "zero" for 0 or "nan" for NaN. Results that are
+// only in the band or only in the last duration are left out.
+func GraphiteBandZScore(e *State, query, duration, period, format string, num float64, zeroVariance string) (r *Results, err error) {
+	var flat float64
+	switch zeroVariance {
+	case "zero":
+	case "nan":
+		flat = math.NaN()
+	default:
+		return nil, fmt.Errorf("graphiteBandZScore: zeroVariance must be zero or nan, got %q", zeroVariance)
+	}
+	band, err := graphiteBand(e, query, duration, period, format, num, graphiteBandOptions{})
+	if err != nil {
+		return nil, err
+	}
+	current, err := GraphiteQuery(e, query, duration, "", format)
+	if err != nil {
+		return nil, err
+	}
+	r = new(Results)
+	for _, res := range current.Results {
+		cs := res.Value.(Series)
+		if len(cs) == 0 {
+			continue
+		}
+		var bs Series
+		for _, b := range band.Results {
+			if b.Group.Equal(res.Group) {
+				bs = b.Value.(Series)
+				break
+			}
+		}
+		if len(bs) == 0 {
+			continue
+		}
+		v, mean, sd := avg(cs), avg(bs), dev(bs)
+		z := (v - mean) / sd
+		if sd == 0 {
+			z = flat
+			if v == mean {
+				z = 0
+			}
+		}
+		res.Value = Number(z)
+		e.AddComputation(res, "graphiteBandZScore current", v)
+		e.AddComputation(res, "graphiteBandZScore band mean", mean)
+		e.AddComputation(res, "graphiteBandZScore band stddev", sd)
+		r.Results = append(r.Results, res)
+	}
+	return r, nil
+}
+
+// graphiteBandTag is the tag GraphiteBandSeparate gives the number of the
+// window of each result.
+const graphiteBandTag = "band"
+
+// GraphiteBandSeparate is like GraphiteBand but doesn't merge the windows.
+// Each window's results get a band tag, 0 for the most recent window, and
+// their timestamps are moved forward by the window's offset so all windows
+// line up with the time range of the most recent one moved to now.
+func GraphiteBandSeparate(e *State, query, duration, period, format string, num float64) (r *Results, err error) {
+	return graphiteBand(e, query, duration, period, format, num, graphiteBandOptions{separate: true})
+}
+
+// graphiteBandOptions changes how graphiteBand fetches and merges windows.
+// The zero value gives the behaviour of the graphiteBand function.
+type graphiteBandOptions struct {
+	// maxDataPoints, if set, is passed to graphite for every window and the
+	// timestamps are aligned to the resulting buckets.
+	maxDataPoints int
+	// consolidateBy names how datapoints of different windows with the same
+	// timestamp are combined: avg or one of graphiteMergeFuncs. The default
+	// is the last window's value.
+	consolidateBy string
+	// maxFailures is how many windows may fail without failing the band.
+	// Their errors are logged and the other windows are merged.
+	maxFailures int
+	// anchor, if set, moves the start of every window back to the start of
+	// the hour, day or week in loc it is in.
+	anchor string
+	// loc, if not nil, is the time zone of the windows.
+	loc *time.Location
+	// separate returns the results of every window with graphiteBandTag
+	// instead of merging them.
+	separate bool
+}
+
+// snapGraphiteTime returns the start of the hour, day or week (starting on
+// Monday) that t is in, in loc or the local time zone if loc is nil.
+func snapGraphiteTime(t time.Time, anchor string, loc *time.Location) time.Time {
+	if loc == nil {
+		loc = time.Local
+	}
+	t = t.In(loc)
+	y, m, d := t.Date()
+	switch anchor {
+	case "hour":
+		return time.Date(y, m, d, t.Hour(), 0, 0, 0, loc)
+	case "week":
+		d -= (int(t.Weekday()) + 6) % 7
+	}
+	return time.Date(y, m, d, 0, 0, 0, 0, loc)
+}
+
+// graphiteSeriesStep returns the smallest interval between datapoints of s,
+// or 0 if s has fewer than two datapoints.
+func graphiteSeriesStep(s Series) time.Duration {
+	var step time.Duration
+	points := NewSortedSeries(s)
+	for i := 1; i < len(points); i++ {
+		if d := points[i].T.Sub(points[i-1].T); step == 0 || d < step {
+			step = d
+		}
+	}
+	return step
+}
+
+// alignGraphiteSeries truncates the timestamps of s to multiples of step.
+func alignGraphiteSeries(s Series, step time.Duration) Series {
+	aligned := make(Series, len(s))
+	for t, v := range s {
+		aligned[t.Truncate(step)] = v
+	}
+	return aligned
+}
+
+func graphiteBand(e *State, query, duration, period, format string, num float64, opts graphiteBandOptions) (r *Results, err error) {
+	d, err := opentsdb.ParseDuration(duration)
+	if err != nil {
+		return nil, err
+	}
+	p, err := opentsdb.ParseDuration(period)
+	if err != nil {
+		return nil, err
+	}
+	return graphiteBandDurations(e, query, d, p, format, num, opts)
+}
+
+// graphiteBandDurations is graphiteBand with the duration and period parsed.
+func graphiteBandDurations(e *State, query string, d, p opentsdb.Duration, format string, num float64, opts graphiteBandOptions) (r *Results, err error) {
+	r = new(Results)
+	r.IgnoreOtherUnjoined = true
+	r.IgnoreUnjoined = true
+	e.Timer.Step("graphiteBand", func(T miniprofiler.Timer) {
+		if num < 1 || num > 100 {
+			err = fmt.Errorf("expr: Band: num out of bounds")
+			return
+		}
+		var f *graphiteFormat
+		f, err = parseGraphiteFormat(format)
+		if err != nil {
+			return
+		}
+		req := &graphite.Request{
+			Targets:       []string{query},
+			MaxDataPoints: opts.maxDataPoints,
+			Location:      opts.loc,
+			NoNullPoints:  e.GraphiteConfig.NoNullPoints,
+		}
+		var step time.Duration
+		if opts.maxDataPoints > 0 {
+			step = time.Duration(d) / time.Duration(opts.maxDataPoints)
+		}
+		merge := graphiteMergeFuncs["last"]
+		if m, ok := graphiteMergeFuncs[opts.consolidateBy]; ok {
+			merge = m
+		}
+		// for averages merge sums the values and counts how many were summed
+		var counts map[*Result]map[time.Time]int
+		if opts.consolidateBy == "avg" {
+			merge = graphiteMergeFuncs["sum"]
+			counts = make(map[*Result]map[time.Time]int)
+		}
+		reqs := make([]*graphite.Request, int(num))
+		now := e.now
+		if opts.anchor == "" {
+			// all windows move by the same jitter, so they still line up
+			now = now.Add(-graphiteBandJitter(e, query))
+		}
+		for i := range reqs {
+			now = now.Add(time.Duration(-p))
+			end := now
+			st := now.Add(time.Duration(-d))
+			if opts.anchor != "" {
+				st = snapGraphiteTime(st, opts.anchor, opts.loc)
+				end = st.Add(time.Duration(d))
+				if end.After(e.now) {
+					end = e.now
+				}
+			}
+			if err = checkGraphiteTimeRange(st, end); err != nil {
+				return
+			}
+			w := *req
+			w.Start = &st
+			w.End = &end
+			reqs[i] = &w
+		}
+		windows := make([][]*Result, len(reqs))
+		errs := make([]error, len(reqs))
+		fetch := func(i int) {
+			s, cluster, err := timeGraphiteRequest(e, reqs[i])
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			results, err := parseGraphiteResponse(reqs[i], &s, f, graphiteConfigOptions(e, cluster, graphiteParseOptions{}))
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			if step > 0 {
+				for _, result := range results {
+					result.Value = alignGraphiteSeries(result.Value.(Series), step)
+				}
+			}
+			windows[i] = results
+		}
+		concurrency := e.GraphiteConfig.BandConcurrency
+		if concurrency < 1 {
+			concurrency = 1
+		}
+		reqCh := make(chan int, len(reqs))
+		for i := range reqs {
+			reqCh <- i
+		}
+		close(reqCh)
+		var wg sync.WaitGroup
+		for i := 0; i < concurrency && i < len(reqs); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range reqCh {
+					fetch(i)
+				}
+			}()
+		}
+		wg.Wait()
+		var failed []int
+		for i := range errs {
+			if errs[i] != nil {
+				failed = append(failed, i)
+			}
+		}
+		if len(failed) > 0 && (len(failed) > opts.maxFailures || len(failed) == len(errs)) {
+			err = errs[failed[0]]
+			return
+		}
+		for _, i := range failed {
+			slog.Errorf("graphiteBand: dropping window %d of %s: %v", i+1, query, errs[i])
+		}
+		// steps are the different resolutions each result was returned at
+		steps := make(map[*Result][]time.Duration)
+		addStep := func(res *Result, s Series) {
+			step := graphiteSeriesStep(s)
+			if step == 0 {
+				return
+			}
+			for _, st := range steps[res] {
+				if st == step {
+					return
+				}
+			}
+			steps[res] = append(steps[res], step)
+		}
+		// merge the windows in order so the result doesn't depend on which
+		// request finished first
+		for i, results := range windows {
+			if errs[i] != nil {
+				continue
+			}
+			if opts.separate {
+				offset := time.Duration(p) * time.Duration(i+1)
+				for _, result := range results {
+					result.Group[graphiteBandTag] = strconv.Itoa(i)
+					shifted := make(Series, len(result.Value.(Series)))
+					for k, v := range result.Value.(Series) {
+						shifted[k.Add(offset)] = v
+					}
+					result.Value = shifted
+					r.Results = append(r.Results, result)
+				}
+				continue
+			}
+			// different graphite requests might return series with different id's.
+			// i.e. a different set of tagsets.  merge the data of corresponding tagsets
+			for _, result := range results {
+				var existing *Result
+				for _, res := range r.Results {
+					if result.Group.Equal(res.Group) {
+						existing = res
+						break
+					}
+				}
+				if existing == nil {
+					// result tagset is new
+					r.Results = append(r.Results, result)
+					addStep(result, result.Value.(Series))
+					if counts != nil {
+						counts[result] = make(map[time.Time]int)
+						for k := range result.Value.(Series) {
+							counts[result][k] = 1
+						}
+					}
+					continue
+				}
+				series := existing.Value.(Series)
+				addStep(existing, result.Value.(Series))
+				for k, v := range result.Value.(Series) {
+					if old, ok := series[k]; ok {
+						v = merge(old, v)
+					}
+					series[k] = v
+					if counts != nil {
+						counts[existing][k]++
+					}
+				}
+			}
+		}
+		for res, c := range counts {
+			series := res.Value.(Series)
+			for k, n := range c {
+				series[k] /= float64(n)
+			}
+		}
+		if opts.maxFailures > 0 {
+			for _, res := range r.Results {
+				e.AddComputation(res, "graphiteBand dropped windows", len(failed))
+			}
+		}
+		for _, res := range r.Results {
+			if len(steps[res]) < 2 {
+				continue
+			}
+			// the merged series has irregular intervals, which functions
+			// like diff or rate don't expect
+			resolutions := fmt.Sprint(steps[res])
+			slog.Warningf("graphiteBand: windows of %s%s have different resolutions %s", query, res.Group, resolutions)
+			e.AddComputation(res, "graphiteBand mixed resolutions", resolutions)
+		}
+	})
+	if err != nil && !IsNoData(err) {
+		return nil, fmt.Errorf("graphiteBand: %v", err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return
+}
+
+func GraphiteQuery(e *State, query string, sduration, eduration, format string) (r *Results, err error) {
+	return graphiteQuery(e, &graphite.Request{Targets: []string{query}}, sduration, eduration, format, graphiteParseOptions{})
+}
+
+// GraphiteMultiQuery is like GraphiteQuery but sends all the comma or pipe
+// separated targets in queries in a single graphite request.
+// If format holds a pipe separated format for every target, each returned
+// series is parsed with the format of the target it matches.
+func GraphiteMultiQuery(e *State, queries string, sduration, eduration, format string) (r *Results, err error) {
+	targets := splitGraphiteTargets(queries)
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("graphiteMulti: no targets in query")
+	}
+	formats := strings.Split(format, "|")
+	if len(formats) == 1 {
+		targets = dedupGraphiteTargets(targets)
+		return graphiteQuery(e, &graphite.Request{Targets: targets}, sduration, eduration, format, graphiteParseOptions{})
+	}
+	if len(formats) != len(targets) {
+		return nil, fmt.Errorf("graphiteMulti: %d formats given for %d targets", len(formats), len(targets))
+	}
+	// the formats are given in the order of the targets, and each returned
+	// series is parsed with the format of the target it matches
+	tf, err := newGraphiteTargetFormats(targets, formats)
+	if err != nil {
+		return nil, fmt.Errorf("graphiteMulti: %v", err)
+	}
+	req := &graphite.Request{Targets: dedupGraphiteTargets(targets)}
+	if err = setGraphiteTimeRange(e, req, sduration, eduration); err != nil {
+		return nil, err
+	}
+	return graphiteFetch(e, req, tf.formats[0].f, graphiteParseOptions{targetFormats: tf})
+}
+
+// graphiteTargetFormats finds the format of the requested target a returned
+// series belongs to. Graphite doesn't say which target a series is for, so
+// series are matched against the targets: first by their name matching a
+// target's glob pattern, then by the longest literal prefix a target shares
+// with the name, which covers functions like sumSeries() that keep the target
+// in the name. Series renamed with alias() and the like can match the wrong
+// target or none.
+type graphiteTargetFormats struct {
+	formats []graphiteTargetFormat
+}
+
+type graphiteTargetFormat struct {
+	target string
+	// glob matches the names of series of a target without functions, it is
+	// nil for other targets.
+	glob *regexp.Regexp
+	// prefix is the part of the target before any glob.
+	prefix string
+	f      *graphiteFormat
+}
+
+func newGraphiteTargetFormats(targets, formats []string) (*graphiteTargetFormats, error) {
+	tf := &graphiteTargetFormats{}
+	seen := make(map[string]string)
+	for i, target := range targets {
+		format := strings.TrimSpace(formats[i])
+		if other, ok := seen[target]; ok {
+			if other != format {
+				return nil, fmt.Errorf("target '%s' is given different formats '%s' and '%s'", target, other, format)
+			}
+			continue
+		}
+		seen[target] = format
+		f, err := parseGraphiteFormat(format)
+		if err != nil {
+			return nil, err
+		}
+		tf.formats = append(tf.formats, graphiteTargetFormat{
+			target: target,
+			glob:   graphiteGlobRE(target),
+			prefix: target[:strings.IndexAny(target+"*", "*?[{")],
+			f:      f,
+		})
+	}
+	return tf, nil
+}
+
+// expanded returns tf for the targets of a request whose targets are those
+// of tf in order, after templates were expanded, so the series are matched
+// with the targets graphite was sent.
+func (tf *graphiteTargetFormats) expanded(targets []string) *graphiteTargetFormats {
+	if len(targets) != len(tf.formats) {
+		return tf
+	}
+	expanded := &graphiteTargetFormats{formats: make([]graphiteTargetFormat, len(tf.formats))}
+	for i, t := range tf.formats {
+		if targets[i] != t.target {
+			t.target = targets[i]
+			t.glob = graphiteGlobRE(t.target)
+			t.prefix = t.target[:strings.IndexAny(t.target+"*", "*?[{")]
+		}
+		expanded.formats[i] = t
+	}
+	return expanded
+}
+
+// format returns the format of the target the series called name belongs to.
+func (tf *graphiteTargetFormats) format(name string) (*graphiteFormat, error) {
+	var match *graphiteTargetFormat
+	for i, t := range tf.formats {
+		if t.target == name || (t.glob != nil && t.glob.MatchString(name)) {
+			if match != nil {
+				return nil, fmt.Errorf("returned target '%s' matches both '%s' and '%s'", name, match.target, t.target)
+			}
+			match = &tf.formats[i]
+		}
+	}
+	if match != nil {
+		return match.f, nil
+	}
+	for i, t := range tf.formats {
+		if t.prefix != "" && strings.HasPrefix(name, t.prefix) && (match == nil || len(t.prefix) > len(match.prefix)) {
+			match = &tf.formats[i]
+		}
+	}
+	if match == nil {
+		return nil, fmt.Errorf("returned target '%s' does not match any requested target", name)
+	}
+	return match.f, nil
+}
+
+// graphiteGlobRE returns a regexp matching the series names of a plain metric
+// pattern like "web{01,02}.cpu*": * and ? within a node, character classes and
+// {a,b} alternatives, which may be nested. It returns nil if pattern uses
+// functions or is invalid.
+func graphiteGlobRE(pattern string) *regexp.Regexp {
+	if strings.ContainsAny(pattern, "()") {
+		return nil
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	braces := 0
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '*':
+			b.WriteString(`[^.]*`)
+		case c == '?':
+			b.WriteString(`[^.]`)
+		case c == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end == -1 {
+				return nil
+			}
+			b.WriteString(pattern[i : i+end+1])
+			i += end
+		case c == '{':
+			braces++
+			b.WriteString("(?:")
+		case c == '}' && braces > 0:
+			braces--
+			b.WriteString(")")
+		case c == ',' && braces > 0:
+			b.WriteString("|")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil
+	}
+	return re
+}
+
+// GraphiteNaNQuery is like GraphiteQuery but stores None datapoints as NaN
+// instead of dropping them.
+func GraphiteNaNQuery(e *State, query string, sduration, eduration, format string) (r *Results, err error) {
+	return graphiteQuery(e, &graphite.Request{Targets: []string{query}}, sduration, eduration, format, graphiteParseOptions{none: graphiteNoneNaN})
+}
+
+// GraphiteZeroQuery is like GraphiteQuery but stores None datapoints as 0
+// instead of dropping them.
+func GraphiteZeroQuery(e *State, query string, sduration, eduration, format string) (r *Results, err error) {
+	return graphiteQuery(e, &graphite.Request{Targets: []string{query}}, sduration, eduration, format, graphiteParseOptions{none: graphiteNoneZero})
+}
+
+// GraphiteNaNTrimQuery is like GraphiteNaNQuery but drops the None datapoints
+// before the first value of each series, so the series of derivative() and
+// nonNegativeDerivative() start at their first value.
+func GraphiteNaNTrimQuery(e *State, query string, sduration, eduration, format string) (r *Results, err error) {
+	return graphiteQuery(e, &graphite.Request{Targets: []string{query}}, sduration, eduration, format, graphiteParseOptions{none: graphiteNoneLeading})
+}
+
+// GraphitePercentileQuery returns a single series holding, for each timestamp,
+// the value at percentile p, between 0 and 1, of the values all series
+// returned for query have at that timestamp.
+func GraphitePercentileQuery(e *State, query string, sduration, eduration string, p float64) (r *Results, err error) {
+	r, err = GraphiteQuery(e, query, sduration, eduration, "")
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[time.Time][]float64)
+	for _, res := range r.Results {
+		for t, v := range res.Value.(Series) {
+			values[t] = append(values[t], v)
+		}
+	}
+	s := make(Series, len(values))
+	for t, x := range values {
+		s[t] = percentileOf(x, p)
+	}
+	r.Results = nil
+	if len(s) > 0 {
+		r.Results = []*Result{{Value: s, Group: opentsdb.TagSet{}}}
+	}
+	return r, nil
+}
+
+// GraphiteNoCacheQuery is like GraphiteQuery but always queries graphite
+// instead of using a cached response.
+func GraphiteNoCacheQuery(e *State, query string, sduration, eduration, format string) (r *Results, err error) {
+	return graphiteQuery(e, &graphite.Request{Targets: []string{query}}, sduration, eduration, format, graphiteParseOptions{noCache: true})
+}
+
+// GraphiteRatioQuery returns num divided by den for each pair of results the
+// two queries return that join like in num / den, at the timestamps both
+// have. Division by zero gives NaN.
+func GraphiteRatioQuery(e *State, num, den, sduration, eduration, format string) (r *Results, err error) {
+	return graphiteRatio(e, num, den, sduration, eduration, format, false)
+}
+
+// GraphiteRatioSkipQuery is like GraphiteRatioQuery but timestamps at which
+// den is zero are left out.
+func GraphiteRatioSkipQuery(e *State, num, den, sduration, eduration, format string) (r *Results, err error) {
+	return graphiteRatio(e, num, den, sduration, eduration, format, true)
+}
+
+func graphiteRatio(e *State, num, den, sduration, eduration, format string, skipZero bool) (r *Results, err error) {
+	a, err := GraphiteQuery(e, num, sduration, eduration, format)
+	if err != nil {
+		return nil, err
+	}
+	b, err := GraphiteQuery(e, den, sduration, eduration, format)
+	if err != nil {
+		return nil, err
+	}
+	r = new(Results)
+	for _, u := range e.union(a, b, "graphiteRatio") {
+		as, aok := u.A.(Series)
+		bs, bok := u.B.(Series)
+		if !aok || !bok {
+			// a result without a counterpart in the other query
+			continue
+		}
+		s := make(Series)
+		for t, av := range as {
+			bv, ok := bs[t]
+			if !ok {
+				continue
+			}
+			if bv == 0 {
+				if !skipZero {
+					s[t] = math.NaN()
+				}
+				continue
+			}
+			s[t] = av / bv
+		}
+		r.Results = append(r.Results, &Result{Value: s, Group: u.Group, Computations: u.Computations})
+	}
+	return r, nil
+}
+
+// GraphiteSummarizeQuery is like GraphiteQuery but combines the datapoints of
+// each series in windows of interval with fn, one of avg, sum, max, min or
+// last. The windows are aligned to multiples of interval and each gets a
+// datapoint at its start.
+func GraphiteSummarizeQuery(e *State, query, sduration, eduration, format, interval, fn string) (r *Results, err error) {
+	return graphiteSummarize(e, query, sduration, eduration, format, interval, fn, 0)
+}
+
+// GraphiteSummarizeXFFQuery is like GraphiteSummarizeQuery but, like graphite's
+// xFilesFactor, a window is NaN unless at least the fraction xFilesFactor of
+// its datapoints are not None.
+func GraphiteSummarizeXFFQuery(e *State, query, sduration, eduration, format, interval, fn string, xFilesFactor float64) (r *Results, err error) {
+	if xFilesFactor < 0 || xFilesFactor > 1 {
+		return nil, fmt.Errorf("graphiteSummarizeXFF: xFilesFactor must be between 0 and 1")
+	}
+	return graphiteSummarize(e, query, sduration, eduration, format, interval, fn, xFilesFactor)
+}
+
+// graphiteSummarize summarizes the series of query. With an xFilesFactor
+// above 0, None datapoints are kept to count them.
+func graphiteSummarize(e *State, query, sduration, eduration, format, interval, fn string, xFilesFactor float64) (r *Results, err error) {
+	d, err := opentsdb.ParseDuration(interval)
+	if err != nil {
+		return nil, err
+	}
+	if d <= 0 {
+		return nil, fmt.Errorf("graphiteSummarize: interval must be positive")
+	}
+	merge, ok := graphiteMergeFuncs[fn]
+	if !ok && fn != "avg" {
+		return nil, fmt.Errorf("graphiteSummarize: unknown function %q, expected avg, sum, max, min or last", fn)
+	}
+	var opts graphiteParseOptions
+	if xFilesFactor > 0 {
+		opts.none = graphiteNoneNaN
+	}
+	r, err = graphiteQuery(e, &graphite.Request{Targets: []string{query}}, sduration, eduration, format, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range r.Results {
+		res.Value = summarizeGraphiteSeries(res.Value.(Series), time.Duration(d), fn, merge, xFilesFactor)
+	}
+	return r, nil
+}
+
+// summarizeGraphiteSeries combines the datapoints of s in windows of step
+// with merge, or averages them for fn avg. NaN datapoints are left out but
+// counted, and windows where fewer than the fraction xFilesFactor of the
+// datapoints are not NaN, or where all are, are NaN.
+func summarizeGraphiteSeries(s Series, step time.Duration, fn string, merge func(a, b float64) float64, xFilesFactor float64) Series {
+	if fn == "avg" {
+		merge = graphiteMergeFuncs["sum"]
+	}
+	counts := make(map[time.Time]int)
+	totals := make(map[time.Time]int)
+	summarized := make(Series)
+	// in time order, so last is the latest datapoint of each window
+	for _, p := range NewSortedSeries(s) {
+		ns := p.T.UnixNano()
+		t := time.Unix(0, ns-ns%int64(step))
+		totals[t]++
+		if math.IsNaN(p.V) {
+			continue
+		}
+		if old, ok := summarized[t]; ok {
+			p.V = merge(old, p.V)
+		}
+		summarized[t] = p.V
+		counts[t]++
+	}
+	for t, total := range totals {
+		n := counts[t]
+		switch {
+		case n == 0 || float64(n)/float64(total) < xFilesFactor:
+			summarized[t] = math.NaN()
+		case fn == "avg":
+			summarized[t] /= float64(n)
+		}
+	}
+	return summarized
+}
+
+// GraphiteTemplateQuery is like GraphiteQuery but graphite replaces the
+// $variables of query with the values given in vars as name=value pairs
+// separated by commas.
+func GraphiteTemplateQuery(e *State, query string, sduration, eduration, format, vars string) (r *Results, err error) {
+	template, err := parseGraphiteTemplateVars("graphiteTemplate", vars)
+	if err != nil {
+		return nil, err
+	}
+	return graphiteQuery(e, &graphite.Request{Targets: []string{query}, Template: template}, sduration, eduration, format, graphiteParseOptions{})
+}
+
+// parseGraphiteTemplateVars parses name=value pairs separated by commas. The
+// errors start with fn.
+func parseGraphiteTemplateVars(fn, vars string) (map[string]string, error) {
+	template := make(map[string]string)
+	if strings.TrimSpace(vars) == "" {
+		return template, nil
+	}
+	for _, kv := range strings.Split(vars, ",") {
+		i := strings.Index(kv, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("%s: variable %q is not name=value", fn, kv)
+		}
+		name := strings.TrimSpace(kv[:i])
+		if name == "" {
+			return nil, fmt.Errorf("%s: variable %q has no name", fn, kv)
+		}
+		if _, ok := template[name]; ok {
+			return nil, fmt.Errorf("%s: variable %s given more than once", fn, name)
+		}
+		template[name] = strings.TrimSpace(kv[i+1:])
+	}
+	return template, nil
+}
+
+// graphiteTemplateRef matches the references to the templates of
+// GraphiteConfig.Templates in a target, like @cpu or @cpu(host=web01).
+var graphiteTemplateRef = regexp.MustCompile(`@(\w+)(?:\(([^()]*)\))?`)
+
+// graphiteTemplateVar matches the variables of a template, like $host.
+var graphiteTemplateVar = regexp.MustCompile(`\$(\w+)`)
+
+var graphiteTemplateName = regexp.MustCompile(`^\w+$`)
+
+// CheckGraphiteTemplates returns an error if templates can't be used as
+// GraphiteConfig.Templates.
+func CheckGraphiteTemplates(templates map[string]string) error {
+	for name, template := range templates {
+		if !graphiteTemplateName.MatchString(name) {
+			return fmt.Errorf("graphite: invalid template name %q", name)
+		}
+		if strings.TrimSpace(template) == "" {
+			return fmt.Errorf("graphite: template %s is empty", name)
+		}
+		// templates aren't expanded again
+		if strings.Contains(template, "@") {
+			return fmt.Errorf("graphite: template %s refers to another template", name)
+		}
+	}
+	return nil
+}
+
+// expandGraphiteTemplates returns targets with each template reference
+// replaced by the template, its variables replaced by the values given with
+// the reference.
+func expandGraphiteTemplates(templates map[string]string, targets []string) ([]string, error) {
+	if len(templates) == 0 {
+		return targets, nil
+	}
+	expanded := make([]string, len(targets))
+	for i, t := range targets {
+		var err error
+		expanded[i] = graphiteTemplateRef.ReplaceAllStringFunc(t, func(ref string) string {
+			if err != nil {
+				return ref
+			}
+			m := graphiteTemplateRef.FindStringSubmatch(ref)
+			var target string
+			target, err = expandGraphiteTemplate(templates, m[1], m[2])
+			return target
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return expanded, nil
+}
+
+// expandGraphiteTarget returns target with the templates of e expanded, for
+// the requests that aren't render requests.
+func expandGraphiteTarget(e *State, target string) (string, error) {
+	targets, err := expandGraphiteTemplates(e.GraphiteConfig.Templates, []string{target})
+	if err != nil {
+		return "", err
+	}
+	return targets[0], nil
+}
+
+// expandGraphiteTemplate returns the template called name with its variables
+// replaced by the name=value pairs of vars. Every variable must be given a
+// value, and every value must be used.
+func expandGraphiteTemplate(templates map[string]string, name, vars string) (string, error) {
+	template, ok := templates[name]
+	if !ok {
+		return "", fmt.Errorf("graphite: unknown template @%s", name)
+	}
+	values, err := parseGraphiteTemplateVars("graphite: template @"+name, vars)
+	if err != nil {
+		return "", err
+	}
+	used := make(map[string]bool)
+	var missing string
+	target := graphiteTemplateVar.ReplaceAllStringFunc(template, func(v string) string {
+		value, ok := values[v[1:]]
+		if !ok {
+			if missing == "" {
+				missing = v
+			}
+			return v
+		}
+		used[v[1:]] = true
+		return value
+	})
+	if missing != "" {
+		return "", fmt.Errorf("graphite: template @%s has no value for %s", name, missing)
+	}
+	unused := make([]string, 0, len(values))
+	for v := range values {
+		if !used[v] {
+			unused = append(unused, v)
+		}
+	}
+	if len(unused) > 0 {
+		sort.Strings(unused)
+		return "", fmt.Errorf("graphite: template @%s has no variable $%s", name, unused[0])
+	}
+	return target, nil
+}
+
+// GraphiteAllowQuery is like GraphiteQuery but the values of some tags must
+// match a regular expression, to keep broad queries from returning a series
+// for each value of a node like a request id. allow has key=regex pairs
+// separated by spaces, and the whole value must match. Series with other
+// values are an error if action is "error" and left out if it is "drop".
+func GraphiteAllowQuery(e *State, query string, sduration, eduration, format, allow, action string) (r *Results, err error) {
+	opts := graphiteParseOptions{}
+	switch action {
+	case "error":
+	case "drop":
+		opts.dropDisallowed = true
+	default:
+		return nil, fmt.Errorf("graphiteAllow: action must be error or drop, got %q", action)
+	}
+	if opts.allow, err = parseGraphiteAllow(allow); err != nil {
+		return nil, err
+	}
+	return graphiteQuery(e, &graphite.Request{Targets: []string{query}}, sduration, eduration, format, opts)
+}
+
+// parseGraphiteAllow parses key=regex pairs separated by spaces. The regular
+// expressions are anchored to match whole tag values.
+func parseGraphiteAllow(allow string) (map[string]*regexp.Regexp, error) {
+	pairs := strings.Fields(allow)
+	if len(pairs) == 0 {
+		return nil, fmt.Errorf("graphiteAllow: no tags to allow values of")
+	}
+	res := make(map[string]*regexp.Regexp, len(pairs))
+	for _, kv := range pairs {
+		i := strings.Index(kv, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("graphiteAllow: %q is not key=regex", kv)
+		}
+		k := kv[:i]
+		if _, ok := res[k]; ok {
+			return nil, fmt.Errorf("graphiteAllow: tag %s given more than once", k)
+		}
+		re, err := regexp.Compile("^(?:" + kv[i+1:] + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("graphiteAllow: invalid regex for %s: %v", k, err)
+		}
+		res[k] = re
+	}
+	return res, nil
+}
+
+// GraphiteRawQuery returns graphite's response to query as JSON in graphite's
+// render format, for templates and uses that don't fit series. The response
+// is cached like the ones of other queries.
+func GraphiteRawQuery(e *State, query, sduration, eduration string) (r *Results, err error) {
+	req := &graphite.Request{Targets: []string{query}}
+	if err = setGraphiteTimeRange(e, req, sduration, eduration); err != nil {
+		return
+	}
+	s, _, err := timeGraphiteRequest(e, req)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		s = graphite.Response{}
+	}
+	b, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return &Results{
+		Results: []*Result{
+			{Value: String(b)},
+		},
+	}, nil
+}
+
+// GraphiteTargetQuery is like GraphiteQuery but each result also has the raw
+// target graphite returned for it as TargetTag.
+func GraphiteTargetQuery(e *State, query string, sduration, eduration, format string) (r *Results, err error) {
+	return graphiteQuery(e, &graphite.Request{Targets: []string{query}}, sduration, eduration, format, graphiteParseOptions{targetTag: true})
+}
+
+// GraphiteTaggedQuery is like GraphiteQuery but series that graphite returns
+// with tags are grouped by those tags. The format is only used for series
+// without tags, so the tag keys of the result are not known in advance.
+func GraphiteTaggedQuery(e *State, query string, sduration, eduration, format string) (r *Results, err error) {
+	return graphiteQuery(e, &graphite.Request{Targets: []string{query}}, sduration, eduration, format, graphiteParseOptions{nativeTags: true})
+}
+
+// GraphiteMergeQuery is like GraphiteQuery but series that map to the same
+// tagset are merged, combining datapoints with matching timestamps with the
+// named function (sum, max, min or last).
+func GraphiteMergeQuery(e *State, query string, sduration, eduration, format, merge string) (r *Results, err error) {
+	m, ok := graphiteMergeFuncs[merge]
+	if !ok {
+		return nil, fmt.Errorf("graphiteMerge: unknown merge function '%s'", merge)
+	}
+	return graphiteQuery(e, &graphite.Request{Targets: []string{query}}, sduration, eduration, format, graphiteParseOptions{merge: m})
+}
+
+// GraphiteKeyedQuery is like GraphiteQuery with an empty format, but the
+// whole target is mapped to the tag named tagKey instead of "key".
+func GraphiteKeyedQuery(e *State, query, sduration, eduration, tagKey string) (r *Results, err error) {
+	if !opentsdb.ValidTSDBString(tagKey) {
+		return nil, fmt.Errorf("graphiteKeyed: invalid tag key '%s'", tagKey)
+	}
+	f := &graphiteFormat{keyTag: tagKey}
+	req := &graphite.Request{Targets: []string{query}}
+	if err = setGraphiteTimeRange(e, req, sduration, eduration); err != nil {
+		return
+	}
+	return graphiteFetch(e, req, f, graphiteParseOptions{})
+}
+
+// GraphiteMDPQuery is like GraphiteQuery but asks graphite to consolidate each
+// series to at most maxDataPoints datapoints before sending it.
+func GraphiteMDPQuery(e *State, query string, sduration, eduration, format string, maxDataPoints float64) (r *Results, err error) {
+	if maxDataPoints < 1 {
+		return nil, fmt.Errorf("graphiteMDP: maxDataPoints must be at least 1")
+	}
+	req := &graphite.Request{
+		Targets:       []string{query},
+		MaxDataPoints: int(maxDataPoints),
+	}
+	return graphiteQuery(e, req, sduration, eduration, format, graphiteParseOptions{})
+}
+
+// graphiteBestResolutionAttempts is how many requests GraphiteBestResolutionQuery
+// makes at most, the first without maxDataPoints and then with halving ones.
+const graphiteBestResolutionAttempts = 4
+
+// GraphiteBestResolutionQuery is like GraphiteQuery but returns the series at
+// the finest resolution with at most maxDataPoints datapoints each. The query
+// is made first without maxDataPoints, and then with decreasing ones until
+// every series fits. Each attempt is cached like any other request.
+func GraphiteBestResolutionQuery(e *State, query string, sduration, eduration, format string, maxDataPoints float64) (r *Results, err error) {
+	if maxDataPoints < 1 {
+		return nil, fmt.Errorf("graphiteBestResolution: maxDataPoints must be at least 1")
+	}
+	f, err := parseGraphiteFormat(format)
+	if err != nil {
+		return
+	}
+	base := graphite.Request{Targets: []string{query}}
+	if err = setGraphiteTimeRange(e, &base, sduration, eduration); err != nil {
+		return
+	}
+	limit := int(maxDataPoints)
+	mdp := 0
+	for i := 0; i < graphiteBestResolutionAttempts && (i == 0 || mdp >= 1); i++ {
+		req := base
+		req.MaxDataPoints = mdp
+		r, err = graphiteFetch(e, &req, f, graphiteParseOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if graphiteMaxDatapoints(r) <= limit {
+			return r, nil
+		}
+		if mdp == 0 {
+			mdp = limit
+		} else {
+			mdp /= 2
+		}
+	}
+	return nil, fmt.Errorf("graphiteBestResolution: graphite returned more than %d datapoints per series after %d attempts", limit, graphiteBestResolutionAttempts)
+}
+
+// graphiteMaxDatapoints returns the most datapoints of any series in r.
+func graphiteMaxDatapoints(r *Results) int {
+	max := 0
+	for _, res := range r.Results {
+		if n := len(res.Value.(Series)); n > max {
+			max = n
+		}
+	}
+	return max
+}
+
+// graphiteQuery sets the time range of req from the durations relative to now,
+// queries graphite and parses the response according to format.
+func graphiteQuery(e *State, req *graphite.Request, sduration, eduration, format string, opts graphiteParseOptions) (r *Results, err error) {
+	f, err := parseGraphiteFormat(format)
+	if err != nil {
+		return
+	}
+	if err = setGraphiteTimeRange(e, req, sduration, eduration); err != nil {
+		return
+	}
+	return graphiteFetch(e, req, f, opts)
+}
+
+// setGraphiteTimeRange sets the time range of req from durations before now.
+// An empty eduration means now.
+func setGraphiteTimeRange(e *State, req *graphite.Request, sduration, eduration string) error {
+	sd, err := opentsdb.ParseDuration(sduration)
+	if err != nil {
+		return err
+	}
+	ed := opentsdb.Duration(e.GraphiteConfig.DefaultEndOffset)
+	if eduration != "" {
+		ed, err = opentsdb.ParseDuration(eduration)
+		if err != nil {
+			return err
+		}
+	}
+	st := e.now.Add(-time.Duration(sd))
+	et := e.now.Add(-time.Duration(ed))
+	if err := checkGraphiteTimeRange(st, et); err != nil {
+		return err
+	}
+	req.Start = &st
+	req.End = &et
+	return nil
+}
+
+// GraphiteCount returns the number of distinct tagsets the series returned
+// by the query map to with format. A query that matches nothing counts 0.
+func GraphiteCount(e *State, query, sduration, eduration, format string) (r *Results, err error) {
+	f, err := parseGraphiteFormat(format)
+	if err != nil {
+		return
+	}
+	req := &graphite.Request{Targets: []string{query}}
+	if err = setGraphiteTimeRange(e, req, sduration, eduration); err != nil {
+		return
+	}
+	s, _, err := timeGraphiteRequest(e, req)
+	if err != nil {
+		return nil, err
+	}
+	if len(s) == 0 {
+		return wrap(0), nil
+	}
+	results, err := parseGraphiteResponse(req, &s, f, graphiteParseOptions{merge: graphiteMergeFuncs["last"]})
+	if err != nil {
+		return nil, err
+	}
+	return wrap(float64(len(results))), nil
+}
+
+// GraphiteIntegralQuery returns the area under each series found with the
+// trapezoidal rule, in value seconds. With gaps "interpolate" None values are
+// skipped so the area spans them, with "break" no area is added for the
+// intervals next to a None value.
+func GraphiteIntegralQuery(e *State, query string, sduration, eduration, format, gaps string) (r *Results, err error) {
+	var opts graphiteParseOptions
+	switch gaps {
+	case "interpolate":
+	case "break":
+		opts.none = graphiteNoneNaN
+	default:
+		return nil, fmt.Errorf("graphiteIntegral: gaps must be interpolate or break, got %q", gaps)
+	}
+	r, err = graphiteQuery(e, &graphite.Request{Targets: []string{query}}, sduration, eduration, format, opts)
+	if err != nil {
+		return nil, err
+	}
+	results := r.Results[:0]
+	for _, res := range r.Results {
+		v, ok := graphiteIntegral(res.Value.(Series))
+		if !ok {
+			continue
+		}
+		res.Value = Number(v)
+		results = append(results, res)
+	}
+	r.Results = results
+	return r, nil
+}
+
+// graphiteIntegral returns the trapezoidal integral of s over time, skipping
+// intervals with a NaN end. ok is false if s has no values that aren't NaN.
+func graphiteIntegral(s Series) (v float64, ok bool) {
+	points := NewSortedSeries(s)
+	for i, p := range points {
+		if math.IsNaN(p.V) {
+			continue
+		}
+		ok = true
+		if i == 0 || math.IsNaN(points[i-1].V) {
+			continue
+		}
+		prev := points[i-1]
+		v += p.T.Sub(prev.T).Seconds() * (prev.V + p.V) / 2
+	}
+	return v, ok
+}
+
+// graphiteFlatlineEmpty are the values graphiteFlatline can give series
+// without any value that isn't None.
+var graphiteFlatlineEmpty = map[string]float64{
+	"unknown":  math.NaN(),
+	"flat":     1,
+	"changing": 0,
+}
+
+// GraphiteFlatlineQuery returns 1 for each series whose values are all the
+// same, and 0 for the others. Series without values get the value empty
+// selects from graphiteFlatlineEmpty.
+func GraphiteFlatlineQuery(e *State, query string, sduration, eduration, format, empty string) (r *Results, err error) {
+	ev, ok := graphiteFlatlineEmpty[empty]
+	if !ok {
+		return nil, fmt.Errorf("graphiteFlatline: empty must be unknown, flat or changing, got %q", empty)
+	}
+	r, err = graphiteQuery(e, &graphite.Request{Targets: []string{query}}, sduration, eduration, format, graphiteParseOptions{none: graphiteNoneNaN})
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range r.Results {
+		res.Value = Number(graphiteFlatline(res.Value.(Series), ev))
+	}
+	return r, nil
+}
+
+// graphiteFlatline returns 1 if all values of s that aren't NaN are equal, 0
+// if they are not and empty if there are none.
+func graphiteFlatline(s Series, empty float64) float64 {
+	var first float64
+	seen := false
+	for _, v := range s {
+		switch {
+		case math.IsNaN(v):
+		case !seen:
+			first, seen = v, true
+		case v != first:
+			return 0
+		}
+	}
+	if !seen {
+		return empty
+	}
+	return 1
+}
+
+// GraphiteNullRatioQuery returns for each series of query the share of its
+// datapoints graphite returned as None, NaN for series without datapoints.
+func GraphiteNullRatioQuery(e *State, query string, sduration, eduration, format string) (r *Results, err error) {
+	type count struct{ nones, total int }
+	counts := make(map[*Result]count)
+	opts := graphiteParseOptions{
+		none: graphiteNoneNaN,
+		counts: func(res *Result, nones, total int) {
+			counts[res] = count{nones, total}
+		},
+	}
+	r, err = graphiteQuery(e, &graphite.Request{Targets: []string{query}}, sduration, eduration, format, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range r.Results {
+		c := counts[res]
+		ratio := math.NaN()
+		if c.total > 0 {
+			ratio = float64(c.nones) / float64(c.total)
+		}
+		res.Value = Number(ratio)
+		e.AddComputation(res, "graphiteNullRatio None datapoints", fmt.Sprintf("%d of %d", c.nones, c.total))
+	}
+	return r, nil
+}
+
+// GraphiteGapsQuery returns for each series of query the number of separate
+// runs of consecutive datapoints graphite returned as None.
+func GraphiteGapsQuery(e *State, query string, sduration, eduration, format string) (r *Results, err error) {
+	r, err = graphiteQuery(e, &graphite.Request{Targets: []string{query}}, sduration, eduration, format, graphiteParseOptions{none: graphiteNoneNaN})
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range r.Results {
+		var gaps, nones int
+		inGap := false
+		for _, p := range NewSortedSeries(res.Value.(Series)) {
+			if !math.IsNaN(p.V) {
+				inGap = false
+				continue
+			}
+			if !inGap {
+				gaps++
+			}
+			inGap = true
+			nones++
+		}
+		res.Value = Number(gaps)
+		e.AddComputation(res, "graphiteGaps None datapoints", fmt.Sprintf("%d in %d gaps", nones, gaps))
+	}
+	return r, nil
+}
+
+// GraphiteRateQuery returns the per second rate of change of each series of
+// query. negative is what is done with negative rates, such as after counter
+// resets: "keep" keeps them and "zero" replaces them with 0. gaps is what is
+// done with None datapoints: "skip" computes the rate across them and "nan"
+// makes the rates from and to them NaN.
+func GraphiteRateQuery(e *State, query string, sduration, eduration, format, negative, gaps string) (r *Results, err error) {
+	var clamp bool
+	switch negative {
+	case "keep":
+	case "zero":
+		clamp = true
+	default:
+		return nil, fmt.Errorf("graphiteRate: negative must be keep or zero, got %q", negative)
+	}
+	var opts graphiteParseOptions
+	switch gaps {
+	case "skip":
+	case "nan":
+		opts.none = graphiteNoneNaN
+	default:
+		return nil, fmt.Errorf("graphiteRate: gaps must be skip or nan, got %q", gaps)
+	}
+	r, err = graphiteQuery(e, &graphite.Request{Targets: []string{query}}, sduration, eduration, format, opts)
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range r.Results {
+		res.Value = graphiteRate(res.Value.(Series), clamp)
+	}
+	return r, nil
+}
+
+// graphiteRate returns the rate of change per second between each datapoint
+// of s and the one before it, at the time of the later one. Rates involving
+// NaN are NaN, and negative rates are 0 if clamp is set.
+func graphiteRate(s Series, clamp bool) Series {
+	points := NewSortedSeries(s)
+	rate := make(Series, len(points))
+	for i := 1; i < len(points); i++ {
+		prev, cur := points[i-1], points[i]
+		v := (cur.V - prev.V) / cur.T.Sub(prev.T).Seconds()
+		if clamp && v < 0 {
+			v = 0
+		}
+		rate[cur.T] = v
+	}
+	return rate
+}
+
+// graphiteConsolidationFuncs are the consolidation functions of graphite's
+// consolidateBy.
+var graphiteConsolidationFuncs = map[string]bool{
+	"average": true,
+	"sum":     true,
+	"min":     true,
+	"max":     true,
+	"first":   true,
+	"last":    true,
+}
+
+// GraphiteConsolidateByQuery is like GraphiteQuery but graphite consolidates
+// datapoints with consolidateBy instead of averaging them. An empty
+// consolidateBy leaves the consolidation to graphite.
+func GraphiteConsolidateByQuery(e *State, query string, sduration, eduration, format, consolidateBy string) (r *Results, err error) {
+	if consolidateBy != "" && !graphiteConsolidationFuncs[consolidateBy] {
+		return nil, fmt.Errorf("graphiteConsolidateBy: unknown consolidation function %q", consolidateBy)
+	}
+	return graphiteQuery(e, &graphite.Request{Targets: []string{query}, ConsolidateBy: consolidateBy}, sduration, eduration, format, graphiteParseOptions{})
+}
+
+// GraphitePrimaryQuery is like GraphiteQuery but never queries the failover
+// clusters, for data only the primary graphite has.
+func GraphitePrimaryQuery(e *State, query string, sduration, eduration, format string) (r *Results, err error) {
+	return graphiteQuery(e, &graphite.Request{Targets: []string{query}}, sduration, eduration, format, graphiteParseOptions{noFailover: true})
+}
+
+// GraphiteMovingAvgQuery is like GraphiteQuery but each datapoint is replaced
+// by the average of the trailing window ending at it. window is a number of
+// datapoints, like "5", or a duration, like "5m". leading is what is done
+// with the datapoints at the start of each series that have fewer before
+// them than the window: "omit" leaves them out and "partial" averages what
+// there is.
+func GraphiteMovingAvgQuery(e *State, query string, sduration, eduration, format, window, leading string) (r *Results, err error) {
+	var partial bool
+	switch leading {
+	case "omit":
+	case "partial":
+		partial = true
+	default:
+		return nil, fmt.Errorf("graphiteMovingAvg: leading must be omit or partial, got %q", leading)
+	}
+	var points int
+	var d opentsdb.Duration
+	if n, err := strconv.Atoi(window); err == nil {
+		if n < 1 {
+			return nil, fmt.Errorf("graphiteMovingAvg: window must be at least 1 datapoint, got %d", n)
+		}
+		points = n
+	} else if d, err = opentsdb.ParseDuration(window); err != nil || d <= 0 {
+		return nil, fmt.Errorf("graphiteMovingAvg: window must be a number of datapoints or a positive duration, got %q", window)
+	}
+	r, err = GraphiteQuery(e, query, sduration, eduration, format)
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range r.Results {
+		res.Value = graphiteMovingAvg(res.Value.(Series), points, time.Duration(d), partial)
+	}
+	return r, nil
+}
+
+// graphiteMovingAvg returns the moving average of s over windows of points
+// datapoints, or of duration d if points is 0. Windows of duration d hold the
+// datapoints after the time d before the datapoint they end at, and are
+// complete once the series started at least a step before that time.
+func graphiteMovingAvg(s Series, points int, d time.Duration, partial bool) Series {
+	sorted := NewSortedSeries(s)
+	step := graphiteSeriesStep(s)
+	avg := make(Series, len(sorted))
+	var sum float64
+	start := 0
+	for i, p := range sorted {
+		sum += p.V
+		complete := true
+		if points > 0 {
+			if i-start >= points {
+				sum -= sorted[start].V
+				start++
+			}
+			complete = i-start+1 == points
+		} else {
+			from := p.T.Add(-d)
+			for !sorted[start].T.After(from) {
+				sum -= sorted[start].V
+				start++
+			}
+			complete = step > 0 && !sorted[0].T.After(from.Add(step))
+		}
+		if complete || partial {
+			avg[p.T] = sum / float64(i-start+1)
+		}
+	}
+	return avg
+}
+
+// GraphiteInterpolateQuery is like GraphiteQuery but the gaps graphite
+// returned None for are filled by linear interpolation between the datapoints
+// around them. Gaps before the first or after the last datapoint stay empty.
+func GraphiteInterpolateQuery(e *State, query string, sduration, eduration, format string) (r *Results, err error) {
+	r, err = GraphiteQuery(e, query, sduration, eduration, format)
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range r.Results {
+		res.Value = graphiteInterpolate(res.Value.(Series))
+	}
+	return r, nil
+}
+
+// graphiteInterpolate fills s at every step between datapoints further than
+// a step apart, the step being the smallest interval between datapoints.
+func graphiteInterpolate(s Series) Series {
+	step := graphiteSeriesStep(s)
+	if step <= 0 {
+		return s
+	}
+	points := NewSortedSeries(s)
+	for i := 1; i < len(points); i++ {
+		prev, cur := points[i-1], points[i]
+		d := cur.T.Sub(prev.T)
+		for t := prev.T.Add(step); t.Before(cur.T); t = t.Add(step) {
+			s[t] = prev.V + (cur.V-prev.V)*float64(t.Sub(prev.T))/float64(d)
+		}
+	}
+	return s
+}
+
+// GraphiteLastAgeQuery returns for each series of query the seconds since its
+// last datapoint that isn't None. empty is what is returned for series with
+// only None datapoints: "window" for the seconds since sduration and "nan"
+// for NaN.
+func GraphiteLastAgeQuery(e *State, query string, sduration, eduration, format, empty string) (r *Results, err error) {
+	if empty != "window" && empty != "nan" {
+		return nil, fmt.Errorf("graphiteLastAge: empty must be window or nan, got %q", empty)
+	}
+	req := &graphite.Request{Targets: []string{query}}
+	r, err = graphiteQuery(e, req, sduration, eduration, format, graphiteParseOptions{none: graphiteNoneNaN})
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range r.Results {
+		var last time.Time
+		for t, v := range res.Value.(Series) {
+			if !math.IsNaN(v) && t.After(last) {
+				last = t
+			}
+		}
+		age := e.now.Sub(last).Seconds()
+		switch {
+		case !last.IsZero():
+		case empty == "window":
+			age = e.now.Sub(*req.Start).Seconds()
+		default:
+			age = math.NaN()
+		}
+		res.Value = Number(age)
+	}
+	return r, nil
+}
+
+// GraphiteLastQuery is like GraphiteQuery but returns the latest value of each
+// series. Series without any values are left out.
+func GraphiteLastQuery(e *State, query string, sduration, eduration, format string) (r *Results, err error) {
+	r, err = GraphiteQuery(e, query, sduration, eduration, format)
+	if err != nil {
+		return nil, err
+	}
+	results := r.Results[:0]
+	for _, res := range r.Results {
+		var last time.Time
+		var v float64
+		for t, val := range res.Value.(Series) {
+			if t.After(last) {
+				last, v = t, val
+			}
+		}
+		if last.IsZero() {
+			continue
+		}
+		res.Value = Number(v)
+		results = append(results, res)
+	}
+	r.Results = results
+	return r, nil
+}
+
+// graphiteFilterOps are the comparisons graphiteFilter can keep series with.
+var graphiteFilterOps = map[string]func(v, threshold float64) bool{
+	"gt": func(v, threshold float64) bool { return v > threshold },
+	"lt": func(v, threshold float64) bool { return v < threshold },
+	"ge": func(v, threshold float64) bool { return v >= threshold },
+	"le": func(v, threshold float64) bool { return v <= threshold },
+}
+
+// GraphiteFilterQuery is like GraphiteQuery but only returns the series whose
+// most recent value compares to threshold with op. Series without values are
+// left out.
+func GraphiteFilterQuery(e *State, query string, sduration, eduration, format, op string, threshold float64) (r *Results, err error) {
+	keep, ok := graphiteFilterOps[op]
+	if !ok {
+		return nil, fmt.Errorf("graphiteFilter: op must be gt, lt, ge or le, got %q", op)
+	}
+	r, err = GraphiteQuery(e, query, sduration, eduration, format)
+	if err != nil {
+		return nil, err
+	}
+	results := r.Results[:0]
+	for _, res := range r.Results {
+		var last time.Time
+		var v float64
+		for t, val := range res.Value.(Series) {
+			if t.After(last) {
+				last, v = t, val
+			}
+		}
+		if last.IsZero() || !keep(v, threshold) {
+			continue
+		}
+		results = append(results, res)
+	}
+	r.Results = results
+	return r, nil
+}
+
+// GraphiteArgMaxQuery is like GraphiteQuery but returns the unix timestamp of
+// the largest value of each series, the earliest one if it occurs more than
+// once. Series without values are left out.
+func GraphiteArgMaxQuery(e *State, query string, sduration, eduration, format string) (r *Results, err error) {
+	return graphiteArgQuery(e, query, sduration, eduration, format, func(a, b float64) bool { return a > b })
+}
+
+// GraphiteArgMinQuery is like GraphiteArgMaxQuery for the smallest value.
+func GraphiteArgMinQuery(e *State, query string, sduration, eduration, format string) (r *Results, err error) {
+	return graphiteArgQuery(e, query, sduration, eduration, format, func(a, b float64) bool { return a < b })
+}
+
+// graphiteArgQuery returns the timestamp of the value of each series that no
+// other value is better than.
+func graphiteArgQuery(e *State, query, sduration, eduration, format string, better func(a, b float64) bool) (r *Results, err error) {
+	r, err = GraphiteQuery(e, query, sduration, eduration, format)
+	if err != nil {
+		return nil, err
+	}
+	results := r.Results[:0]
+	for _, res := range r.Results {
+		var at time.Time
+		var best float64
+		for t, v := range res.Value.(Series) {
+			if math.IsNaN(v) {
+				continue
+			}
+			if at.IsZero() || better(v, best) || (v == best && t.Before(at)) {
+				at, best = t, v
+			}
+		}
+		if at.IsZero() {
+			continue
+		}
+		res.Value = Number(at.Unix())
+		results = append(results, res)
+	}
+	r.Results = results
+	return r, nil
+}
+
+// GraphiteExists returns 1 if graphite has any metric or metric node matching
+// query, and 0 otherwise. It asks graphite's find endpoint, so no datapoints
+// are fetched.
+func GraphiteExists(e *State, query string) (r *Results, err error) {
+	if query, err = expandGraphiteTarget(e, query); err != nil {
+		return nil, err
+	}
+	req := &graphite.FindRequest{Query: query}
+	val, err := graphiteCachedCall(e, "find", query, "graphite-find-"+query, func(ctx context.Context) (interface{}, error) {
+		return graphite.Find(ctx, e.GraphiteContext, req)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("graphiteExists: %v", err)
+	}
+	if len(val.([]graphite.Metric)) > 0 {
+		return wrap(1), nil
+	}
+	return wrap(0), nil
+}
+
+func graphiteExpandTags(args []parse.Node) (parse.Tags, error) {
+	format, err := graphiteConstArg(args[1], "format")
+	if err != nil {
+		return nil, err
+	}
+	return graphiteFormatTags(format)
+}
+
+// GraphiteExpand returns a 1 for each metric path the wildcards of query
+// expand to, with the tags format gives it and the path as TargetTag, to
+// check a format before querying any datapoints. It asks graphite's expand
+// endpoint.
+func GraphiteExpand(e *State, query, format string) (r *Results, err error) {
+	f, err := parseGraphiteFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	if query, err = expandGraphiteTarget(e, query); err != nil {
+		return nil, err
+	}
+	req := &graphite.ExpandRequest{Query: query}
+	val, err := graphiteCachedCall(e, "expand", query, "graphite-expand-"+query, func(ctx context.Context) (interface{}, error) {
+		return graphite.Expand(ctx, e.GraphiteContext, req)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("graphiteExpand: %v", err)
+	}
+	paths := val.([]string)
+	// the paths are only added as a tag once all are parsed, so paths the
+	// format gives the same tags are an error like they are for queries
+	p := newGraphiteParser(&graphite.Request{Targets: []string{query}, URL: req.URL}, f, graphiteConfigOptions(e, 0, graphiteParseOptions{}))
+	resultPaths := make(map[*Result]string)
+	for _, path := range paths {
+		n := len(p.results)
+		if err := p.add(&graphite.Series{Target: path}); err != nil {
+			return nil, err
+		}
+		if len(p.results) > n {
+			resultPaths[p.results[n]] = path
+		}
+	}
+	results, err := p.done()
+	if err != nil {
+		return nil, err
+	}
+	for _, res := range results {
+		res.Value = Number(1)
+		res.Group[TargetTag] = opentsdb.MustReplace(resultPaths[res], "_")
+	}
+	return &Results{Results: results}, nil
+}
+
+// graphiteEventTag is the tag of the results of GraphiteEvents holding the
+// event tag they are for.
+const graphiteEventTag = "tag"
+
+func graphiteEventsTags(args []parse.Node) (parse.Tags, error) {
+	return parse.Tags{graphiteEventTag: struct{}{}}, nil
+}
+
+// GraphiteEvents returns a series for each tag of the graphite events with
+// tags, a space separated list that matches all events if empty. The series
+// have a 1 at the time of each event with the tag. Events without tags are
+// left out.
+func GraphiteEvents(e *State, tags, sduration, eduration string) (r *Results, err error) {
+	var tr graphite.Request
+	if err := setGraphiteTimeRange(e, &tr, sduration, eduration); err != nil {
+		return nil, err
+	}
+	req := &graphite.EventsRequest{Start: tr.Start, End: tr.End, Tags: strings.Fields(tags)}
+	key := fmt.Sprintf("graphite-events-%d-%d-%s", tr.Start.Unix(), tr.End.Unix(), strings.Join(req.Tags, " "))
+	val, err := graphiteCachedCall(e, "events", key, key, func(ctx context.Context) (interface{}, error) {
+		return graphite.Events(ctx, e.GraphiteContext, req)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("graphiteEvents: %v", err)
+	}
+	series := make(map[string]Series)
+	for _, ev := range val.([]graphite.Event) {
+		t := time.Unix(int64(ev.When), 0)
+		for _, tag := range ev.Tags {
+			if tag = opentsdb.MustReplace(tag, "_"); tag == "" {
+				continue
+			}
+			if series[tag] == nil {
+				series[tag] = make(Series)
+			}
+			series[tag][t] = 1
+		}
+	}
+	r = new(Results)
+	for tag, s := range series {
+		r.Results = append(r.Results, &Result{
+			Value: s,
+			Group: opentsdb.TagSet{graphiteEventTag: tag},
+		})
+	}
+	sort.Sort(ResultSliceByGroup(r.Results))
+	return r, nil
+}
+
+// GraphiteEstimate is an estimate of how much data a graphite query fetches,
+// made without fetching any datapoints.
+type GraphiteEstimate struct {
+	Query string
+	// Paths are the metric paths in Query, and Series how many metrics
+	// graphite has matching them.
+	Paths  []string
+	Series int
+	Start  time.Time
+	End    time.Time
+	// Step is the assumed resolution of the metrics, and Datapoints how many
+	// datapoints of all series the time range has at that resolution.
+	Step       time.Duration
+	Datapoints int
+}
+
+// EstimateGraphiteQuery estimates the cost of querying graphite for query
+// from start to end, assuming metrics are stored every step. The series are
+// counted with graphite's find endpoint, once for every metric path in query.
+func EstimateGraphiteQuery(ctx context.Context, c graphite.Context, query string, start, end time.Time, step time.Duration) (*GraphiteEstimate, error) {
+	if err := checkGraphiteTimeRange(start, end); err != nil {
+		return nil, err
+	}
+	if step <= 0 {
+		return nil, fmt.Errorf("graphite: step must be positive")
+	}
+	est := &GraphiteEstimate{
+		Query: query,
+		Paths: graphiteTargetPaths(query),
+		Start: start,
+		End:   end,
+		Step:  step,
+	}
+	for _, path := range est.Paths {
+		metrics, err := graphite.Find(ctx, c, &graphite.FindRequest{Query: path})
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range metrics {
+			if m.Leaf == 1 {
+				est.Series++
+			}
+		}
+	}
+	points := int((end.Sub(start) + step - 1) / step)
+	est.Datapoints = est.Series * points
+	return est, nil
+}
+
+// graphiteTargetPaths returns the distinct metric paths in target, the
+// arguments of its functions that are neither quoted, numbers nor booleans.
+func graphiteTargetPaths(target string) []string {
+	var paths []string
+	seen := make(map[string]bool)
+	var quote rune
+	depth, start := 0, 0
+	for i, c := range target + ")" {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+			start = i + 1
+			continue
+		case c == '"' || c == '\'':
+			quote = c
+			start = i + 1
+			continue
+		case c == '{' || c == '[':
+			depth++
+			continue
+		case c == '}' || c == ']':
+			depth--
+			continue
+		case depth > 0 || !strings.ContainsRune("(), ", c):
+			continue
+		}
+		tok := target[start:i]
+		start = i + 1
+		if tok == "" || c == '(' || seen[tok] {
+			continue
+		}
+		if _, err := strconv.ParseFloat(tok, 64); err == nil {
+			continue
+		}
+		if tok == "true" || tok == "false" || tok == "None" {
+			continue
+		}
+		seen[tok] = true
+		paths = append(paths, tok)
+	}
+	return paths
+}
+
+// GraphiteFromUntilQuery is like GraphiteQuery but passes from and until to
+// graphite as is, letting graphite resolve relative times like "-1h" or
+// "midnight". An empty until means now.
+func GraphiteFromUntilQuery(e *State, query, from, until, format string) (r *Results, err error) {
+	if from == "" {
+		return nil, fmt.Errorf("graphiteFromUntil: from must not be empty")
+	}
+	f, err := parseGraphiteFormat(format)
+	if err != nil {
+		return
+	}
+	req := &graphite.Request{
+		Targets: []string{query},
+		From:    from,
+		Until:   until,
+	}
+	return graphiteFetch(e, req, f, graphiteParseOptions{})
+}
+
+// GraphiteAbsoluteQuery is like GraphiteQuery but the time range is given as
+// absolute start and end unix timestamps instead of durations before now.
+func GraphiteAbsoluteQuery(e *State, query string, start, end float64, format string) (r *Results, err error) {
+	f, err := parseGraphiteFormat(format)
+	if err != nil {
+		return
+	}
+	st := time.Unix(int64(start), 0)
+	et := time.Unix(int64(end), 0)
+	if err = checkGraphiteTimeRange(st, et); err != nil {
+		return
+	}
+	req := &graphite.Request{
+		Targets: []string{query},
+		Start:   &st,
+		End:     &et,
+	}
+	return graphiteFetch(e, req, f, graphiteParseOptions{})
+}
+
+// graphiteFetch queries graphite with req and parses the response. Only the
+// raw response is cached, and every call parses it with its own format into
+// new results, so queries that differ only in format share the request but
+// never each other's results. Responses that aren't batched are parsed series
+// by series as they are decoded, also while they are read to be cached.
+func graphiteFetch(e *State, req *graphite.Request, f *graphiteFormat, opts graphiteParseOptions) (r *Results, err error) {
+	// only queries that skip None datapoints let graphite leave them out,
+	// as it would also leave out the series that only have None datapoints
+	req.NoNullPoints = e.GraphiteConfig.NoNullPoints && opts.none == graphiteNoneSkip
+	var p *graphiteParser
+	stream := &graphiteStream{
+		start: func(cluster int) {
+			o := opts
+			if o.targetFormats != nil {
+				o.targetFormats = o.targetFormats.expanded(req.Targets)
+			}
+			p = newGraphiteParser(req, f, graphiteConfigOptions(e, cluster, o))
+		},
+		add: func(s *graphite.Series) error {
+			return p.add(s)
+		},
+	}
+	s, cluster, err := timeGraphiteRequestCached(e, req, !opts.noCache, !opts.noFailover, stream)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		// the response wasn't streamed
+		stream.start(cluster)
+		for i := range s {
+			if err := p.add(&s[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	r = new(Results)
+	results, err := p.done()
+	if err != nil {
+		return nil, err
+	}
+	r.Results = results
+	for _, res := range results {
+		c := p.nones[res]
+		if opts.counts != nil {
+			opts.counts(res, c.nones, c.total)
+		}
+		if c.imprecise > 0 {
+			e.AddComputation(res, "graphite imprecise datapoints", fmt.Sprintf("%d of %d integers are too large for a float64 and were rounded", c.imprecise, c.total))
+		}
+	}
+	if ratio := e.GraphiteConfig.NoneWarnRatio; ratio > 0 {
+		for _, res := range results {
+			c := p.nones[res]
+			if c.total > 0 && float64(c.nones)/float64(c.total) > ratio {
+				e.AddComputation(res, "graphite None datapoints", fmt.Sprintf("%d of %d", c.nones, c.total))
+			}
+		}
+	}
+	return
+}
+
+func graphiteKeyedTagQuery(args []parse.Node) (parse.Tags, error) {
+	key, err := graphiteConstArg(args[3], "tag key")
+	if err != nil {
+		return nil, err
+	}
+	return parse.Tags{key: struct{}{}}, nil
+}
+
+// graphiteMultiTagQuery returns the tag keys of graphiteMulti, which are only
+// known in advance if all targets' formats give the same keys.
+func graphiteMultiTagQuery(args []parse.Node) (parse.Tags, error) {
+	formats, err := graphiteConstArg(args[3], "format")
+	if err != nil {
+		return nil, err
+	}
+	var tags parse.Tags
+	for _, format := range strings.Split(formats, "|") {
+		t, err := graphiteFormatTags(strings.TrimSpace(format))
+		if err != nil {
+			return nil, err
+		}
+		if tags != nil && !tags.Equal(t) {
+			return nil, nil
+		}
+		tags = t
+	}
+	return tags, nil
+}
+
+// graphitePercentileTags returns no tags since graphitePercentile combines
+// all series into one.
+func graphitePercentileTags(args []parse.Node) (parse.Tags, error) {
+	return parse.Tags{}, nil
+}
+
+// graphiteRatioTags returns the tags of graphiteRatio, whose format is its
+// fifth argument and applies to both queries.
+func graphiteRatioTags(args []parse.Node) (parse.Tags, error) {
+	var tags parse.Tags
+	for _, query := range args[:2] {
+		t, err := graphiteTagQuery([]parse.Node{query, args[2], args[3], args[4]})
+		if t == nil || err != nil {
+			return t, err
+		}
+		tags = t
+	}
+	return tags, nil
+}
+
+// graphiteBandSeparateTags returns the tags of graphiteBandSeparate, the
+// format's and graphiteBandTag.
+func graphiteBandSeparateTags(args []parse.Node) (parse.Tags, error) {
+	t, err := graphiteTagQuery(args)
+	if t == nil || err != nil {
+		return t, err
+	}
+	if _, ok := t[graphiteBandTag]; ok {
+		return nil, fmt.Errorf("graphiteBandSeparate: format must not have a %s tag", graphiteBandTag)
+	}
+	t[graphiteBandTag] = struct{}{}
+	return t, nil
+}
+
+// graphiteAllowTags returns the tags of graphiteAllow, checking that the
+// allowed tags are ones the format has.
+func graphiteAllowTags(args []parse.Node) (parse.Tags, error) {
+	t, err := graphiteTagQuery(args)
+	if t == nil || err != nil {
+		return t, err
+	}
+	text, err := graphiteConstArg(args[4], "allow")
+	if err != nil {
+		return nil, err
+	}
+	allow, err := parseGraphiteAllow(text)
+	if err != nil {
+		return nil, err
+	}
+	for k := range allow {
+		if _, ok := t[k]; !ok {
+			return nil, fmt.Errorf("graphiteAllow: tag %s is not in the format", k)
+		}
+	}
+	return t, nil
+}
+
+// graphiteTaggedTags leaves the tags of graphiteTagged unchecked, since they
+// are only known once graphite returns the series.
+func graphiteTaggedTags(args []parse.Node) (parse.Tags, error) {
+	return nil, nil
+}
+
+func graphiteTagQuery(args []parse.Node) (parse.Tags, error) {
+	format, err := graphiteConstArg(args[3], "format")
+	if err != nil {
+		return nil, err
+	}
+	return graphiteFormatTags(format)
+}
+
+// graphiteConstArg returns the text of the argument n, which decides the
+// tags of the results so it must be a string literal rather than an
+// expression only evaluated later. name is what the error calls it.
+func graphiteConstArg(n parse.Node, name string) (string, error) {
+	s, ok := n.(*parse.StringNode)
+	if !ok {
+		return "", fmt.Errorf("graphite: the %s must be a constant string, not %s", name, n)
+	}
+	return s.Text, nil
+}
+
+// graphiteFormatTags returns the tag keys format gives results, or an error if
+// the format is invalid or would make invalid tag keys.
+func graphiteFormatTags(format string) (parse.Tags, error) {
+	f, err := parseGraphiteFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	t := make(parse.Tags)
+	if len(f.candidates) > 0 {
+		// results have the keys of the candidate they matched
+		for _, c := range f.candidates {
+			ct, err := graphiteFormatTags(c.text)
+			if err != nil {
+				return nil, err
+			}
+			for k := range ct {
+				t[k] = struct{}{}
+			}
+		}
+		return t, nil
+	}
+	for _, k := range f.keys() {
+		if !opentsdb.ValidTSDBString(k) {
+			return nil, fmt.Errorf("graphite: invalid tag key '%s' in format '%s'", k, format)
+		}
+		if _, ok := t[k]; ok {
+			return nil, fmt.Errorf("graphite: tag key '%s' is used more than once in format '%s'", k, format)
+		}
+		t[k] = struct{}{}
+	}
+	return t, nil
+}
+
+// ValidateGraphiteQuery checks a graphite query and format without querying
+// graphite. It returns the tag keys the results would have and the problems
+// found, so rules can be checked while they are written.
+func ValidateGraphiteQuery(query, format string) (parse.Tags, []error) {
+	var errs []error
+	if len(splitGraphiteTargets(query)) == 0 {
+		errs = append(errs, fmt.Errorf("graphite: no targets in query"))
+	}
+	if err := checkGraphiteBrackets(query); err != nil {
+		errs = append(errs, err)
+	}
+	tags, err := graphiteFormatTags(format)
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return tags, errs
+}
+
+// checkGraphiteBrackets returns an error if the parentheses, braces, brackets
+// or quotes of query are not balanced.
+func checkGraphiteBrackets(query string) error {
+	var stack []rune
+	var quote rune
+	closing := map[rune]rune{')': '(', '}': '{', ']': '['}
+	for _, c := range query {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(' || c == '{' || c == '[':
+			stack = append(stack, c)
+		case closing[c] != 0:
+			if len(stack) == 0 || stack[len(stack)-1] != closing[c] {
+				return fmt.Errorf("graphite: unexpected '%c' in query '%s'", c, query)
+			}
+			stack = stack[:len(stack)-1]
+		}
+	}
+	if quote != 0 {
+		return fmt.Errorf("graphite: unterminated quote in query '%s'", query)
+	}
+	if len(stack) != 0 {
+		return fmt.Errorf("graphite: unclosed '%c' in query '%s'", stack[len(stack)-1], query)
+	}
+	return nil
+}
+
+// GraphiteConfig contains the settings used when evaluating graphite queries.
+// The zero value disables all of them.
+type GraphiteConfig struct {
+	// State is what the queries of the primary graphite remember between
+	// evaluations. If it is nil nothing is remembered.
+	State *GraphiteState
+	// EmptyResponseTTL is how long a request that returned no series is
+	// answered with an empty response without querying graphite again. It
+	// needs State.
+	EmptyResponseTTL time.Duration
+	// Retries is how many times a failed query is retried. The wait before
+	// each retry starts at RetryBackoff and doubles every time.
+	Retries      int
+	RetryBackoff time.Duration
+	// RetryDeadline, if set, limits the total time spent on a query
+	// including retries. No retry is made that would wait past it.
+	RetryDeadline time.Duration
+	// Timeout, if set, cancels each query attempt that takes longer.
+	Timeout time.Duration
+	// BandConcurrency is how many of a band's windows are queried at the
+	// same time. Below 1 they are queried one after another.
+	BandConcurrency int
+	// RateLimit, if set, is how many queries per second are sent to graphite
+	// by all expressions together. RateBurst queries can be sent at once.
+	RateLimit float64
+	RateBurst int
+	// CacheMetricsByQuery tags the cache hit and miss metrics of graphite
+	// queries with the name of what they query.
+	CacheMetricsByQuery bool
+	// DefaultEndOffset is how far before now queries end when they are
+	// given no end duration.
+	DefaultEndOffset time.Duration
+	// BandJitter, if at least a second, is the most the windows of a band
+	// are moved back in time, by an amount depending on the rule and query.
+	BandJitter time.Duration
+	// Location, if not nil, is the time zone graphite is asked to use and
+	// calendar boundaries are found in, instead of the local one.
+	Location *time.Location
+	// MaxSeries, if set, is the most series a query may return. Queries
+	// returning more fail as soon as the series after the limit is read.
+	MaxSeries int
+	// CSV asks graphite for CSV responses instead of JSON.
+	CSV bool
+	// StrictTimestamps makes series with more than one datapoint at the same
+	// timestamp an error. Otherwise the last of them is used.
+	StrictTimestamps bool
+	// NoneWarnRatio, if set, is the share of None datapoints above which a
+	// result gets a computation saying how many of its datapoints were None.
+	NoneWarnRatio float64
+	// NoNullPoints asks graphite to leave out None datapoints for queries
+	// that would skip them anyway. Series with only None datapoints are then
+	// left out too, instead of being results without datapoints.
+	NoNullPoints bool
+	// DebugTimings indents the queries shown in the expression profiler.
+	// They are compact otherwise, which is cheaper for wide requests.
+	DebugTimings bool
+	// CircuitBreakerFailures, if set, is how many queries in a row may fail
+	// before queries fail without being sent for CircuitBreakerCooldown.
+	// After that a single query is sent to probe if graphite works again.
+	// The breaker is kept in State.
+	CircuitBreakerFailures int
+	CircuitBreakerCooldown time.Duration
+	// TimestampsAtBucketEnd moves datapoints from the start of the bucket
+	// graphite consolidated them into to its end, as found from the step of
+	// each series.
+	TimestampsAtBucketEnd bool
+	// StrictNodes makes targets with more nodes than their format, which has
+	// no **, an error. Otherwise the extra nodes are ignored.
+	StrictNodes bool
+	// SourceTag, if set, is a tag added with the value Source to the results
+	// of queries, so results of different graphite clusters don't collide.
+	SourceTag string
+	Source    string
+	// FailoverSources are the values of SourceTag for the results of each
+	// failover cluster instead of Source.
+	FailoverSources []string
+	// UserAgent, if set, is the User-Agent of queries. OriginHeader, if set,
+	// is a header sent with the origin of the expression, such as the name
+	// of the alert, so graphite's logs tell who sent a query.
+	UserAgent    string
+	OriginHeader string
+	// BatchWindow, if set, is how long queries wait for others to send
+	// their targets to graphite in the same render request, with at most
+	// BatchMaxTargets targets if that is set.
+	BatchWindow     time.Duration
+	BatchMaxTargets int
+	// Templates are targets that queries can refer to by name, like
+	// @cpu(host=web01) for the template cpu with $host replaced by web01.
+	Templates map[string]string
+}
+
+// checkGraphiteTimeRange returns an error if start is not before end, which
+// graphite would silently answer with no data.
+func checkGraphiteTimeRange(start, end time.Time) error {
+	if !start.Before(end) {
+		return fmt.Errorf("graphite: start time %v is not before end time %v", start.Unix(), end.Unix())
+	}
+	return nil
+}
+
+// GraphiteState is what the queries of a primary graphite remember between
+// evaluations. The GraphiteConfig of all evaluations querying that graphite
+// share one, made with NewGraphiteState.
+type GraphiteState struct {
+	// empty remembers until when requests that returned no series should be
+	// answered from memory. Unlike e.Cache it outlives a single check run,
+	// so it is keyed on how long before now the time range starts and ends
+	// instead of the absolute times, and otherwise on all the cache key
+	// covers. Absolute time ranges, like those of graphiteAbsolute, are thus
+	// never shared with later runs or with other absolute time ranges.
+	emptyMu sync.Mutex
+	empty   map[string]time.Time
+	breaker graphiteCircuitBreaker
+}
+
+// NewGraphiteState returns a GraphiteState that remembers nothing yet.
+func NewGraphiteState() *GraphiteState {
+	return &GraphiteState{empty: make(map[string]time.Time)}
+}
+
+func graphiteEmptyKey(req *graphite.Request, now time.Time) string {
+	timeRange := req.From + "-" + req.Until
+	if req.Start != nil && req.End != nil {
+		timeRange = now.Sub(*req.Start).String() + "-" + now.Sub(*req.End).String()
+	}
+	return req.CacheKeyTimeRange(timeRange)
+}
+
+// cachedEmpty reports if req, evaluated at now, is known to return an empty
+// response.
+func (s *GraphiteState) cachedEmpty(req *graphite.Request, now time.Time) bool {
+	key := graphiteEmptyKey(req, now)
+	s.emptyMu.Lock()
+	defer s.emptyMu.Unlock()
+	until, ok := s.empty[key]
+	if ok && time.Now().After(until) {
+		delete(s.empty, key)
+		return false
+	}
+	return ok
+}
+
+// cacheEmpty remembers that req, evaluated at evalNow, returned an empty
+// response for ttl.
+func (s *GraphiteState) cacheEmpty(req *graphite.Request, evalNow time.Time, ttl time.Duration) {
+	now := time.Now()
+	s.emptyMu.Lock()
+	defer s.emptyMu.Unlock()
+	for k, until := range s.empty {
+		if now.After(until) {
+			delete(s.empty, k)
+		}
+	}
+	s.empty[graphiteEmptyKey(req, evalNow)] = now.Add(ttl)
+}
+
+// GraphiteResponseSummary describes what graphite returned for one request.
+type GraphiteResponseSummary struct {
+	Targets []string
+	Series  []GraphiteSeriesSummary
+}
+
+// GraphiteSeriesSummary describes a single series returned by graphite.
+type GraphiteSeriesSummary struct {
+	Target     string
+	Datapoints int
+	// Nones is how many of the datapoints were None.
+	Nones int
+}
+
+func summarizeGraphiteResponse(req *graphite.Request, resp graphite.Response) GraphiteResponseSummary {
+	s := GraphiteResponseSummary{
+		Targets: req.Targets,
+		Series:  make([]GraphiteSeriesSummary, len(resp)),
+	}
+	for i := range resp {
+		s.Series[i] = summarizeGraphiteResponseSeries(&resp[i])
+	}
+	return s
+}
+
+func summarizeGraphiteResponseSeries(series *graphite.Series) GraphiteSeriesSummary {
+	s := GraphiteSeriesSummary{Target: series.Target, Datapoints: len(series.Datapoints)}
+	for _, dp := range series.Datapoints {
+		if len(dp) > 0 && len(dp[0].String()) == 0 {
+			s.Nones++
+		}
+	}
+	return s
+}
+
+// GraphiteResponses returns summaries of the responses to the graphite
+// requests made so far, in the order they were made.
+func (e *State) GraphiteResponses() []GraphiteResponseSummary {
+	return e.graphiteResponses
+}
+
+// queryGraphite queries graphite with req. If the primary graphite fails and
+// failover is set, the failover clusters are queried in order until one
+// answers. Only the last error is returned. cluster is the graphite that
+// answered: 0 for the primary and i for failover cluster i. If stream is set
+// the series are handed to it instead of returned in resp.
+func queryGraphite(e *State, req *graphite.Request, failover bool, stream *graphiteStream) (resp graphite.Response, cluster int, err error) {
+	resp, err = queryGraphiteRetries(e, req, e.GraphiteContext, 0, stream)
+	if !failover {
+		return
+	}
+	for i, c := range e.GraphiteFailover {
+		if err == nil || e.Context().Err() != nil {
+			return
+		}
+		if graphiteQueryFault(err) {
+			// other clusters answer the same
+			return
+		}
+		slog.Warningf("graphite: querying failover cluster %d for %v after: %v", i+1, req.Targets, err)
+		collect.Add("graphite.failover", nil, 1)
+		resp, err = queryGraphiteRetries(e, req, c, i+1, stream)
+		cluster = i + 1
+	}
+	return
+}
+
+// graphiteStream receives the series of a response as they are decoded, so
+// the response is never held in memory as a whole. start is called with the
+// cluster being queried before every attempt, so the series of a retried or
+// failed over query are added from the first again.
+type graphiteStream struct {
+	start func(cluster int)
+	add   func(s *graphite.Series) error
+}
+
+// graphiteStreamError is returned for queries whose series the stream failed
+// to add.
+type graphiteStreamError struct {
+	err error
+}
+
+func (err *graphiteStreamError) Error() string {
+	return err.err.Error()
+}
+
+// graphiteQueryFault reports if err is the fault of the query rather than of
+// graphite, so retrying it or asking another cluster fails the same.
+func graphiteQueryFault(err error) bool {
+	switch err.(type) {
+	case *graphiteSeriesLimitError, *graphiteStreamError:
+		return true
+	}
+	return false
+}
+
+// graphiteSource returns the value of GraphiteConfig.SourceTag for the results
+// of cluster, as returned by queryGraphite.
+func graphiteSource(c GraphiteConfig, cluster int) string {
+	if cluster > 0 && cluster <= len(c.FailoverSources) {
+		return c.FailoverSources[cluster-1]
+	}
+	return c.Source
+}
+
+// queryGraphiteRetries queries the graphite of g, which is cluster, with req,
+// retrying failures as configured.
+func queryGraphiteRetries(e *State, req *graphite.Request, g graphite.Context, cluster int, stream *graphiteStream) (resp graphite.Response, err error) {
+	err = graphiteRetry(e, cluster == 0, func(ctx context.Context) (err error) {
+		resp, err = queryGraphiteOnce(ctx, e, req, g, cluster, stream)
+		return err
+	})
+	return
+}
+
+// graphiteRetry calls call until it succeeds, retrying the failures that
+// graphiteUnhealthy blames on graphite as configured. call is cancelled once
+// the retry deadline passes. Only the last error is returned. The circuit
+// breaker only guards the primary graphite, and counts the call as a whole
+// however often it was retried.
+func graphiteRetry(e *State, primary bool, call func(ctx context.Context) error) (err error) {
+	c := e.GraphiteConfig
+	if primary && c.CircuitBreakerFailures > 0 && c.State != nil {
+		b := &c.State.breaker
+		if err := b.allow(time.Now(), c.CircuitBreakerFailures); err != nil {
+			return err
+		}
+		defer func() {
+			// aborted evaluations and queries graphite rejected don't say
+			// anything about graphite's health
+			if (err != nil && !graphiteUnhealthy(err)) || e.Context().Err() != nil {
+				b.skip()
+				return
+			}
+			b.record(time.Now(), err != nil, c.CircuitBreakerFailures, c.CircuitBreakerCooldown)
+		}()
+	}
+	ctx := e.Context()
+	var deadline time.Time
+	if c.RetryDeadline > 0 {
+		deadline = time.Now().Add(c.RetryDeadline)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	backoff := c.RetryBackoff
+	for tries := 1; ; tries++ {
+		err = call(ctx)
+		if err == nil {
+			return
+		}
+		if ctx.Err() != nil && e.Context().Err() == nil {
+			return &graphiteTimeoutError{c.RetryDeadline, err}
+		}
+		if tries > c.Retries || !graphiteUnhealthy(err) {
+			// other errors, like graphite rejecting the query, would
+			// come back the same
+			return
+		}
+		if !deadline.IsZero() && time.Now().Add(backoff).After(deadline) {
+			return
+		}
+		if e.Context().Err() != nil {
+			// the evaluation was aborted, don't retry
+			return
+		}
+		slog.Errorf("Error on graphite query %d: %s", tries, err.Error())
+		if graphiteSleep(ctx, backoff) != nil {
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// graphiteBatches combines the queries of concurrent evaluations.
+var graphiteBatches = &graphiteBatcher{batches: make(map[string]*graphiteBatch)}
+
+// graphiteBatcher combines the plain metric path targets of queries sent
+// within GraphiteConfig.BatchWindow of each other, and that differ in nothing
+// else, headers included, into a single render request, and hands each query
+// the series matching its targets.
+type graphiteBatcher struct {
+	sync.Mutex
+	batches map[string]*graphiteBatch
+}
+
+// graphiteBatch is a render request being collected or sent. done is closed
+// once resp and err are set. The request is sent with e, whose context is
+// cancelled once all the queries waiting for it are aborted.
+type graphiteBatch struct {
+	req     graphite.Request
+	e       *State
+	cancel  context.CancelFunc
+	targets map[string]bool
+	queries int
+	waiting int
+	done    chan struct{}
+	resp    graphite.Response
+	cluster int
+	err     error
+}
+
+// graphiteBatchableTarget matches targets that are metric paths, whose series
+// can be told apart by their names.
+var graphiteBatchableTarget = regexp.MustCompile(`^[\w\-.*?\[\]{},:]+$`)
+
+// query is like queryGraphite but req may be sent together with others.
+func (b *graphiteBatcher) query(e *State, req *graphite.Request, failover bool) (graphite.Response, int, error) {
+	c := e.GraphiteConfig
+	if c.BatchWindow <= 0 || !graphiteBatchable(req) {
+		return queryGraphite(e, req, failover, nil)
+	}
+	key := graphiteBatchKey(req, failover)
+	b.Lock()
+	batch := b.batches[key]
+	if batch == nil || (c.BatchMaxTargets > 0 && len(batch.targets)+len(req.Targets) > c.BatchMaxTargets) {
+		// a full batch is sent on its own timer
+		ctx, cancel := context.WithCancel(context.Background())
+		batch = &graphiteBatch{
+			req:     *req,
+			e:       &State{ctx: ctx, Timer: e.Timer, Origin: e.Origin, Backends: e.Backends},
+			cancel:  cancel,
+			targets: make(map[string]bool),
+			done:    make(chan struct{}),
+		}
+		batch.req.URL = nil
+		b.batches[key] = batch
+		time.AfterFunc(c.BatchWindow, func() { b.send(key, batch, failover) })
+	}
+	for _, t := range req.Targets {
+		batch.targets[t] = true
+	}
+	batch.queries++
+	batch.waiting++
+	b.Unlock()
+	select {
+	case <-batch.done:
+	case <-e.Context().Done():
+		b.leave(key, batch)
+		return nil, 0, fmt.Errorf("graphite: query aborted: %v", e.Context().Err())
+	}
+	if _, ok := batch.err.(*graphiteSeriesLimitError); ok {
+		// the limit is for the series of a single query
+		return queryGraphite(e, req, failover, nil)
+	}
+	if batch.err != nil {
+		return nil, 0, batch.err
+	}
+	req.URL = batch.req.URL
+	// the queries of a batch share what it cost
+	req.Bytes += batch.req.Bytes / int64(batch.queries)
+	return graphiteBatchSeries(batch.resp, req.Targets), batch.cluster, nil
+}
+
+// leave is called by a query no longer waiting for batch. Once no query is
+// waiting, batch is cancelled and no other query joins it.
+func (b *graphiteBatcher) leave(key string, batch *graphiteBatch) {
+	b.Lock()
+	defer b.Unlock()
+	batch.waiting--
+	if batch.waiting > 0 {
+		return
+	}
+	if b.batches[key] == batch {
+		delete(b.batches, key)
+	}
+	batch.cancel()
+}
+
+// send sends batch once its window is over. It is cancelled only once all
+// the evaluations waiting for it are aborted, not with any one of them.
+func (b *graphiteBatcher) send(key string, batch *graphiteBatch, failover bool) {
+	defer batch.cancel()
+	b.Lock()
+	if b.batches[key] == batch {
+		delete(b.batches, key)
+	}
+	req := batch.req
+	req.Targets = make([]string, 0, len(batch.targets))
+	for t := range batch.targets {
+		req.Targets = append(req.Targets, t)
+	}
+	sort.Strings(req.Targets)
+	queries := batch.queries
+	b.Unlock()
+	if queries > 1 {
+		collect.Add("graphite.batched_queries", nil, int64(queries))
+	}
+	batch.resp, batch.cluster, batch.err = queryGraphite(batch.e, &req, failover, nil)
+	batch.req.URL = req.URL
+	batch.req.Bytes = req.Bytes
+	close(batch.done)
+}
+
+// graphiteBatchable reports if req can be sent together with other queries.
+func graphiteBatchable(req *graphite.Request) bool {
+	if len(req.Template) > 0 || req.ConsolidateBy != "" {
+		return false
+	}
+	for _, t := range req.Targets {
+		if !graphiteBatchableTarget.MatchString(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// graphiteBatchKey returns the key of the batches req can be part of, which
+// is everything about it but its targets.
+func graphiteBatchKey(req *graphite.Request, failover bool) string {
+	r := *req
+	r.Targets = nil
+	names := make([]string, 0, len(r.Header))
+	for k := range r.Header {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var header []string
+	for _, k := range names {
+		header = append(header, fmt.Sprintf("%s: %s", k, strings.Join(r.Header[k], ", ")))
+	}
+	return fmt.Sprintf("%s-%v-%v-%v-%q", r.CacheKey(), r.CSV, r.Timeout, failover, header)
+}
+
+// graphiteBatchSeries returns the series of resp each of targets matches, as
+// graphite would have returned them for targets alone. resp has a series once
+// for every target of the batch matching it, so each target only gets the
+// first.
+func graphiteBatchSeries(resp graphite.Response, targets []string) graphite.Response {
+	var matched graphite.Response
+	for _, t := range targets {
+		re := graphiteGlobRE(t)
+		if re == nil {
+			// like graphite, an invalid pattern matches nothing
+			continue
+		}
+		seen := make(map[string]bool)
+		for _, s := range resp {
+			if !seen[s.Target] && re.MatchString(s.Target) {
+				seen[s.Target] = true
+				matched = append(matched, s)
+			}
+		}
+	}
+	return matched
+}
+
+// graphiteSleep waits for d, or returns the error of ctx if it is done first.
+func graphiteSleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// graphiteRateLimit spaces out the queries sent to graphite by all
+// expressions, so a batch of checks doesn't send them all at once.
+var graphiteRateLimit graphiteLimiter
+
+// graphiteLimiter is a token bucket, tracking the time at which the bucket
+// would be empty again.
+type graphiteLimiter struct {
+	sync.Mutex
+	full time.Time
+}
+
+// reserve takes a token from the bucket, which holds burst tokens and gets
+// rate tokens per second, and returns how long to wait before using it.
+func (l *graphiteLimiter) reserve(now time.Time, rate float64, burst int) time.Duration {
+	if burst < 1 {
+		burst = 1
+	}
+	interval := time.Duration(float64(time.Second) / rate)
+	l.Lock()
+	defer l.Unlock()
+	if l.full.Before(now) {
+		l.full = now
+	}
+	wait := l.full.Sub(now) - time.Duration(burst-1)*interval
+	l.full = l.full.Add(interval)
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// graphiteSeriesLimitError is returned for queries that return more than
+// GraphiteConfig.MaxSeries series.
+type graphiteSeriesLimitError struct {
+	targets []string
+	max     int
+}
+
+func (err *graphiteSeriesLimitError) Error() string {
+	return fmt.Sprintf("graphite: query %s matched more than %d series, limit is %d", strings.Join(err.targets, ", "), err.max, err.max)
+}
+
+// graphiteCircuitBreaker fails queries fast while graphite keeps failing, so
+// the queries of all expressions don't each wait for their timeout. It opens after a number of consecutive failed queries.
+// While it is open queries fail without being sent. After the cooldown the
+// next query is let through as a probe, and closes the breaker if it works.
+type graphiteCircuitBreaker struct {
+	sync.Mutex
+	failures int
+	// until is when the breaker lets a probe through again.
+	until   time.Time
+	open    bool
+	probing bool
+	once    sync.Once
+}
+
+// graphiteCircuitOpenError is returned for queries the breaker didn't send.
+type graphiteCircuitOpenError struct {
+	failures int
+	until    time.Time
+}
+
+func (err *graphiteCircuitOpenError) Error() string {
+	return fmt.Sprintf("graphite: circuit breaker open after %d consecutive failed queries, not querying graphite until %s", err.failures, err.until.Format(time.RFC3339))
+}
+
+// allow returns an error if a query at now must not be sent because the
+// breaker opened after max failures.
+func (b *graphiteCircuitBreaker) allow(now time.Time, max int) error {
+	b.once.Do(func() {
+		collect.Set("graphite.circuit_breaker_open", nil, func() interface{} {
+			b.Lock()
+			defer b.Unlock()
+			if b.open {
+				return 1
+			}
+			return 0
+		})
+	})
+	b.Lock()
+	defer b.Unlock()
+	if b.failures < max {
+		return nil
+	}
+	if now.Before(b.until) || b.probing {
+		collect.Add("graphite.circuit_breaker_rejected", nil, 1)
+		return &graphiteCircuitOpenError{b.failures, b.until}
+	}
+	b.probing = true
+	return nil
+}
+
+// skip is called instead of record for queries whose outcome doesn't count,
+// so another probe can be sent.
+func (b *graphiteCircuitBreaker) skip() {
+	b.Lock()
+	b.probing = false
+	b.Unlock()
+}
+
+// record updates the breaker with the outcome of a query that was sent at
+// now, opening it for cooldown after max consecutive failures.
+func (b *graphiteCircuitBreaker) record(now time.Time, failed bool, max int, cooldown time.Duration) {
+	b.Lock()
+	defer b.Unlock()
+	b.probing = false
+	if !failed {
+		if b.open {
+			slog.Infof("graphite: circuit breaker closed, queries succeed again")
+		}
+		b.failures = 0
+		b.open = false
+		return
+	}
+	b.failures++
+	if b.failures >= max {
+		if !b.open {
+			slog.Errorf("graphite: circuit breaker opened after %d consecutive failed queries", b.failures)
+			collect.Add("graphite.circuit_breaker_opened", nil, 1)
+		}
+		b.open = true
+		b.until = now.Add(cooldown)
+	}
+}
+
+func init() {
+	metadata.AddMetricMeta("bosun.graphite.circuit_breaker_open", metadata.Gauge, metadata.Bool,
+		"1 while graphite queries fail without being sent because too many queries failed in a row.")
+	metadata.AddMetricMeta("bosun.graphite.circuit_breaker_opened", metadata.Counter, metadata.Count,
+		"The number of times the graphite circuit breaker opened.")
+	metadata.AddMetricMeta("bosun.graphite.circuit_breaker_rejected", metadata.Counter, metadata.Query,
+		"The number of graphite queries that failed without being sent because the circuit breaker was open.")
+	metadata.AddMetricMeta("bosun.graphite.batched_queries", metadata.Counter, metadata.Query,
+		"The number of graphite queries sent together with other queries in a single render request.")
+	metadata.AddMetricMeta("bosun.graphite.failover", metadata.Counter, metadata.Query,
+		"The number of graphite queries sent to a failover cluster because the cluster before it failed.")
+	metadata.AddMetricMeta("bosun.graphite.response_bytes", metadata.Counter, metadata.Bytes,
+		"The bytes of the responses read from graphite, before they are decompressed.")
+}
+
+// queryGraphiteOnce queries the graphite of g, which is cluster, with req,
+// cancelling the query after req.Timeout.
+func queryGraphiteOnce(ctx context.Context, e *State, req *graphite.Request, g graphite.Context, cluster int, stream *graphiteStream) (resp graphite.Response, err error) {
+	max := e.GraphiteConfig.MaxSeries
+	if stream != nil {
+		stream.start(cluster)
+	}
+	series := 0
+	err = graphiteCall(ctx, e, req.Timeout, func(ctx context.Context) error {
+		return graphite.QueryStream(ctx, g, req, func(s graphite.Series) error {
+			if max > 0 && series >= max {
+				return &graphiteSeriesLimitError{req.Targets, max}
+			}
+			series++
+			if stream != nil {
+				if err := stream.add(&s); err != nil {
+					return &graphiteStreamError{err}
+				}
+				return nil
+			}
+			resp = append(resp, s)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// graphiteCall calls call once the rate limit lets it query graphite, with
+// ctx cancelled after timeout if it is set.
+func graphiteCall(parent context.Context, e *State, timeout time.Duration, call func(ctx context.Context) error) error {
+	ctx := parent
+	if c := e.GraphiteConfig; c.RateLimit > 0 {
+		if err := graphiteSleep(ctx, graphiteRateLimit.reserve(time.Now(), c.RateLimit, c.RateBurst)); err != nil {
+			return fmt.Errorf("graphite: query aborted: %v", err)
+		}
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	err := call(ctx)
+	if err != nil && ctx.Err() == context.DeadlineExceeded && parent.Err() == nil {
+		return &graphiteTimeoutError{timeout, err}
+	}
+	return err
+}
+
+// graphiteCachedCall calls call with the protections of render queries, the
+// rate limit, timeout, retries and circuit breaker of the primary graphite,
+// caching its value at key. step names the step of e.Timer and of the cache
+// hit metric, and name labels the step.
+func graphiteCachedCall(e *State, step, name, key string, call func(ctx context.Context) (interface{}, error)) (val interface{}, err error) {
+	e.Timer.StepCustomTiming("graphite", step, name, func() {
+		getFn := func() (val interface{}, err error) {
+			err = graphiteRetry(e, true, func(ctx context.Context) error {
+				return graphiteCall(ctx, e, e.GraphiteConfig.Timeout, func(ctx context.Context) (err error) {
+					val, err = call(ctx)
+					return err
+				})
+			})
+			return val, err
 		}
-		var val interface{}
 		var hit bool
 		val, err, hit = e.Cache.Get(key, getFn)
-		collectCacheHit(e.Cache, "graphite", hit)
-		resp = val.(graphite.Response)
+		collectCacheHit(e.Cache, "graphite_"+step, hit)
 	})
+	return val, err
+}
+
+// graphiteTimeoutError is returned for queries cancelled after their timeout
+// or the retry deadline.
+type graphiteTimeoutError struct {
+	timeout time.Duration
+	err     error
+}
+
+func (err *graphiteTimeoutError) Error() string {
+	return fmt.Sprintf("graphite: query timed out after %v: %v", err.timeout, err.err)
+}
+
+// graphiteUnhealthy reports if err says graphite is in trouble: the query
+// timed out, couldn't be sent, or graphite answered with a server error.
+// Other errors, like graphite rejecting a malformed target, are the fault of
+// the query.
+func graphiteUnhealthy(err error) bool {
+	switch err := err.(type) {
+	case *graphiteTimeoutError:
+		return true
+	case *graphite.RequestError:
+		return err.StatusCode == 0 || err.StatusCode >= 500
+	}
+	return false
+}
+
+// graphiteQueryName returns the first node of the first metric path in
+// targets, such as "collectd" for "sumSeries(collectd.*.cpu)", to tag metrics
+// about the query with.
+func graphiteQueryName(targets []string) string {
+	if len(targets) == 0 {
+		return "none"
+	}
+	t := targets[0]
+	if m := graphiteFirstNodeRE.FindStringSubmatch(t); m != nil {
+		return m[1]
+	}
+	if name := opentsdb.MustReplace(t, "_"); name != "" {
+		return name
+	}
+	return "none"
+}
+
+var graphiteFirstNodeRE = regexp.MustCompile(`(?:^|[(,\s])([\w-]+)\.`)
+
+// graphiteQueryTiming is recorded in the profiler for every graphite request.
+type graphiteQueryTiming struct {
+	Request *graphite.Request
+	// CacheHit is true if the response came from the cache.
+	CacheHit bool
+	// QueryTime is the time spent waiting for graphite, CacheTime the rest.
+	QueryTime string
+	CacheTime string
+	// Bytes is the size of the responses read from graphite for the query,
+	// 0 for cache hits.
+	Bytes      int64
+	Series     int
+	Datapoints int
+	Response   *GraphiteResponseSummary `json:",omitempty"`
+	Error      string                   `json:",omitempty"`
+}
+
+func timeGraphiteRequest(e *State, req *graphite.Request) (resp graphite.Response, cluster int, err error) {
+	return timeGraphiteRequestCached(e, req, true, true, nil)
+}
+
+// graphiteCachedResponse is what e.Cache holds for a graphite request: the
+// response and the cluster that answered it, as returned by queryGraphite.
+type graphiteCachedResponse struct {
+	resp    graphite.Response
+	cluster int
+}
+
+// graphiteRequestHeader returns the headers identifying the queries of e, or
+// nil if none are configured.
+func graphiteRequestHeader(e *State) http.Header {
+	c := e.GraphiteConfig
+	if c.UserAgent == "" && (c.OriginHeader == "" || e.Origin == "") {
+		return nil
+	}
+	h := make(http.Header)
+	if c.UserAgent != "" {
+		h.Set("User-Agent", c.UserAgent)
+	}
+	if c.OriginHeader != "" && e.Origin != "" {
+		h.Set(c.OriginHeader, e.Origin)
+	}
+	return h
+}
+
+// timeGraphiteRequestCached is like timeGraphiteRequest but if cached is
+// false graphite is always queried, and the response isn't cached. If
+// failover is false only the primary graphite is queried. If stream is set
+// and the response isn't batched, the series are handed to stream as they are
+// decoded rather than returned in resp, unless the response is cached: then
+// they are returned too, and a series stream fails to add only fails this
+// query, not the queries sharing the response.
+func timeGraphiteRequestCached(e *State, req *graphite.Request, cached, failover bool, stream *graphiteStream) (resp graphite.Response, cluster int, err error) {
+	if req.Targets, err = expandGraphiteTemplates(e.GraphiteConfig.Templates, req.Targets); err != nil {
+		return nil, 0, err
+	}
+	req.Timeout = e.GraphiteConfig.Timeout
+	req.CSV = e.GraphiteConfig.CSV
+	req.Header = graphiteRequestHeader(e)
+	if req.Location == nil {
+		req.Location = e.GraphiteConfig.Location
+	}
+	e.graphiteMu.Lock()
+	e.graphiteQueries = append(e.graphiteQueries, *req)
+	e.graphiteMu.Unlock()
+	key := req.CacheKey()
+	ttl := e.GraphiteConfig.EmptyResponseTTL
+	c := e.Cache
+	if !cached || e.GraphiteConfig.State == nil {
+		ttl = 0
+	}
+	if !cached {
+		c = nil
+	}
+	var streamed []GraphiteSeriesSummary
+	var kept graphite.Response
+	var streamErr error
+	if e.GraphiteConfig.BatchWindow > 0 && graphiteBatchable(req) {
+		// batched responses are shared, so they are kept whole
+		stream = nil
+	} else if stream != nil {
+		s := *stream
+		stream = &graphiteStream{
+			start: func(cluster int) {
+				streamed, kept, streamErr = streamed[:0], kept[:0], nil
+				s.start(cluster)
+			},
+			add: func(series *graphite.Series) error {
+				streamed = append(streamed, summarizeGraphiteResponseSeries(series))
+				if c == nil {
+					return s.add(series)
+				}
+				// cached responses are shared with queries of other formats
+				kept = append(kept, *series)
+				if streamErr == nil {
+					streamErr = s.add(series)
+				}
+				return nil
+			},
+		}
+	}
+	var queryTime time.Duration
+	var queryBytes int64
+	getFn := func() (interface{}, error) {
+		if ttl > 0 && e.GraphiteConfig.State.cachedEmpty(req, e.now) {
+			return graphiteCachedResponse{resp: graphite.Response{}}, nil
+		}
+		// errors aren't cached, so neither is what an aborted query read
+		if err := e.Context().Err(); err != nil {
+			return graphiteCachedResponse{}, fmt.Errorf("graphite: query aborted: %v", err)
+		}
+		start, read := time.Now(), req.Bytes
+		var resp graphite.Response
+		var cluster int
+		var err error
+		if stream != nil {
+			resp, cluster, err = queryGraphite(e, req, failover, stream)
+			if err == nil && c != nil {
+				resp = kept
+			}
+		} else {
+			resp, cluster, err = graphiteBatches.query(e, req, failover)
+		}
+		queryTime = time.Since(start)
+		queryBytes = req.Bytes - read
+		collect.Add("graphite.response_bytes", nil, queryBytes)
+		// only cache genuinely empty responses, not failures to talk to graphite
+		// or empty answers of a failover cluster
+		if err == nil && cluster == 0 && len(resp) == 0 && len(streamed) == 0 && ttl > 0 {
+			e.GraphiteConfig.State.cacheEmpty(req, e.now, ttl)
+		}
+		return graphiteCachedResponse{resp, cluster}, err
+	}
+	start := time.Now()
+	val, err, hit := c.Get(key, getFn)
+	end := time.Now()
+	var cacheTags opentsdb.TagSet
+	if e.GraphiteConfig.CacheMetricsByQuery {
+		cacheTags = opentsdb.TagSet{"query": graphiteQueryName(req.Targets)}
+	}
+	collectCacheHitTags(c, "graphite", hit, cacheTags)
+	cachedResp := val.(graphiteCachedResponse)
+	resp, cluster = cachedResp.resp, cachedResp.cluster
+	if err == nil && streamErr != nil {
+		err = &graphiteStreamError{streamErr}
+	}
+	timing := graphiteQueryTiming{
+		Request:   req,
+		CacheHit:  hit,
+		QueryTime: queryTime.String(),
+		CacheTime: (end.Sub(start) - queryTime).String(),
+		Bytes:     queryBytes,
+	}
+	if err == nil {
+		summary := summarizeGraphiteResponse(req, resp)
+		if stream != nil && c == nil {
+			summary.Series = streamed
+		}
+		e.graphiteMu.Lock()
+		e.graphiteResponses = append(e.graphiteResponses, summary)
+		e.graphiteMu.Unlock()
+		timing.Response = &summary
+		timing.Series = len(summary.Series)
+		for _, s := range summary.Series {
+			timing.Datapoints += s.Datapoints
+		}
+	} else {
+		timing.Error = err.Error()
+	}
+	var b []byte
+	if e.GraphiteConfig.DebugTimings {
+		b, _ = json.MarshalIndent(timing, "", "  ")
+	} else {
+		b, _ = json.Marshal(timing)
+	}
+	e.Timer.AddCustomTiming("graphite", "query", start, end, string(b))
 	return
 }
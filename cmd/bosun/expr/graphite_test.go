@@ -0,0 +1,2801 @@
+package expr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"bosun.org/cmd/bosun/cache"
+	"bosun.org/cmd/bosun/expr/parse"
+	"bosun.org/graphite"
+	"bosun.org/models"
+	"bosun.org/opentsdb"
+	"github.com/MiniProfiler/go/miniprofiler"
+)
+
+// graphiteTestContext is a graphite.Context that records the requests it
+// receives and answers them with a canned response.
+type graphiteTestContext struct {
+	sync.Mutex
+	resp graphite.Response
+	reqs []*graphite.Request
+}
+
+func (c *graphiteTestContext) Query(r *graphite.Request) (graphite.Response, error) {
+	c.Lock()
+	c.reqs = append(c.reqs, r)
+	c.Unlock()
+	return c.resp, nil
+}
+
+func (c *graphiteTestContext) Find(ctx context.Context, r *graphite.FindRequest) ([]graphite.Metric, error) {
+	var metrics []graphite.Metric
+	for _, s := range c.resp {
+		if s.Target == r.Query {
+			metrics = append(metrics, graphite.Metric{ID: s.Target, Leaf: 1})
+		}
+	}
+	return metrics, nil
+}
+
+func graphiteTestResponse(t *testing.T, s string) graphite.Response {
+	var resp graphite.Response
+	if err := json.Unmarshal([]byte(s), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func graphiteTestState(c graphite.Context) *State {
+	return &State{
+		now:            time.Unix(1000, 0),
+		Backends:       &Backends{GraphiteContext: c},
+		BosunProviders: &BosunProviders{},
+		Timer:          new(miniprofiler.Profile),
+	}
+}
+
+func TestSplitGraphiteTargets(t *testing.T) {
+	tests := []struct {
+		in  string
+		out []string
+	}{
+		{"a.b", []string{"a.b"}},
+		{"a.b,c.d", []string{"a.b", "c.d"}},
+		{"a.b | c.d", []string{"a.b", "c.d"}},
+		{"sumSeries(a.b,c.d)|a.{x,y}.z", []string{"sumSeries(a.b,c.d)", "a.{x,y}.z"}},
+		{"aliasSub(a.b, 'x|y', 'z'),c", []string{"aliasSub(a.b, 'x|y', 'z')", "c"}},
+		{" , ", nil},
+	}
+	for _, test := range tests {
+		if got := splitGraphiteTargets(test.in); !reflect.DeepEqual(got, test.out) {
+			t.Errorf("%q: expected %q, got %q", test.in, test.out, got)
+		}
+	}
+}
+
+func TestGraphiteMultiQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01.cpu", "datapoints": [[1, 900], [2, 960]]},
+		{"target": "web02.mem", "datapoints": [[3, 900]]}
+	]`)}
+	r, err := GraphiteMultiQuery(graphiteTestState(c), "web01.cpu|web02.mem|web01.cpu", "5m", "", "host.metric")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.reqs) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(c.reqs))
+	}
+	if targets := c.reqs[0].Targets; !reflect.DeepEqual(targets, []string{"web01.cpu", "web02.mem"}) {
+		t.Errorf("unexpected targets %q", targets)
+	}
+	if len(r.Results) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(r.Results))
+	}
+	expected := opentsdb.TagSet{"host": "web02", "metric": "mem"}
+	if !r.Results[1].Group.Equal(expected) {
+		t.Errorf("expected group %v, got %v", expected, r.Results[1].Group)
+	}
+}
+
+func TestGraphiteMultiQueryFormats(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "collectd.web01.cpu", "datapoints": [[1, 900]]},
+		{"target": "dc1.b.web02.mem", "datapoints": [[2, 900]]},
+		{"target": "scale(app.web.hits,2)", "datapoints": [[3, 900]]}
+	]`)}
+	queries := "collectd.web*.cpu|dc?.{a,b}.*.mem|scale(app.*.hits,2)"
+	r, err := GraphiteMultiQuery(graphiteTestState(c), queries, "5m", "", ".host.metric|dc..host.metric|.host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// results are sorted by tagset
+	expected := []opentsdb.TagSet{
+		{"dc": "dc1", "host": "web02", "metric": "mem"},
+		{"host": "web01", "metric": "cpu"},
+		{"host": "web"},
+	}
+	for i, res := range r.Results {
+		if !res.Group.Equal(expected[i]) {
+			t.Errorf("expected tags %v, got %v", expected[i], res.Group)
+		}
+	}
+	if _, err := GraphiteMultiQuery(graphiteTestState(c), queries, "5m", "", "host|host"); err == nil {
+		t.Error("expected error for fewer formats than targets")
+	}
+	c.resp = graphiteTestResponse(t, `[{"target": "other.cpu", "datapoints": [[1, 900]]}]`)
+	if _, err := GraphiteMultiQuery(graphiteTestState(c), queries, "5m", "", "host|host|host"); err == nil {
+		t.Error("expected error for a series matching no target")
+	}
+	args := []parse.Node{&parse.StringNode{}, nil, nil, &parse.StringNode{Text: "host.metric|.host.metric"}}
+	if tags, err := graphiteMultiTagQuery(args); err != nil || tags.String() != "host,metric" {
+		t.Errorf("expected tags host,metric, got %v %v", tags, err)
+	}
+	args[3] = &parse.StringNode{Text: "host|dc.host"}
+	if tags, err := graphiteMultiTagQuery(args); err != nil || tags != nil {
+		t.Errorf("expected unknown tags for differing formats, got %v %v", tags, err)
+	}
+}
+
+func TestGraphiteMDPQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 900]]}
+	]`)}
+	if _, err := GraphiteMDPQuery(graphiteTestState(c), "*", "5m", "", "host", 100); err != nil {
+		t.Fatal(err)
+	}
+	req := c.reqs[0]
+	if req.MaxDataPoints != 100 {
+		t.Errorf("expected MaxDataPoints 100, got %d", req.MaxDataPoints)
+	}
+	other := *req
+	other.MaxDataPoints = 0
+	if req.CacheKey() == other.CacheKey() {
+		t.Errorf("MaxDataPoints is not part of the cache key")
+	}
+}
+
+func TestGraphiteFormatTags(t *testing.T) {
+	tests := []struct {
+		format string
+		target string
+		tags   opentsdb.TagSet // nil for error
+	}{
+		{"", "a.b.c", opentsdb.TagSet{"key": "a.b.c"}},
+		{"host", "web01", opentsdb.TagSet{"host": "web01"}},
+		{".host..core", "collectd.web01.cpu.3", opentsdb.TagSet{"host": "web01", "core": "3"}},
+		{".host..core", "collectd.web01.cpu", nil},
+		{"2=host.4=disk", "a.b.web01.d.sda", opentsdb.TagSet{"host": "web01", "disk": "sda"}},
+		{"2=host.4=disk", "a.b.web01.d", nil},
+		{"dc.3=host", "ny.x.y.web01", opentsdb.TagSet{"dc": "ny", "host": "web01"}},
+		{"*.host.*.core", "collectd.web01.cpu.3", opentsdb.TagSet{"host": "web01", "core": "3"}},
+		{"**.host.metric", "a.b.c.web01.cpu", opentsdb.TagSet{"host": "web01", "metric": "cpu"}},
+		{"**.host.metric", "web01.cpu", opentsdb.TagSet{"host": "web01", "metric": "cpu"}},
+		{"**.host.metric", "cpu", nil},
+		{"app.**.*.host", "billing.x.y.z.web01", opentsdb.TagSet{"app": "billing", "host": "web01"}},
+		{"app.**.*.host", "billing.web01", nil},
+		{".host", "servers.web01;dc=ny", opentsdb.TagSet{"host": "web01;dc=ny"}},
+		{".host:lower", "servers.Host_PROD_01", opentsdb.TagSet{"host": "host_prod_01"}},
+		{"1=host:upper.**.metric", "a.web01.b.cpu", opentsdb.TagSet{"host": "WEB01", "metric": "cpu"}},
+		{"app.host?unknown.metric", "billing..cpu", opentsdb.TagSet{"app": "billing", "host": "unknown", "metric": "cpu"}},
+		{"app.host?unknown.metric", "billing.web01.cpu", opentsdb.TagSet{"app": "billing", "host": "web01", "metric": "cpu"}},
+		{"1=host:lower?none", "a..b", opentsdb.TagSet{"host": "none"}},
+		{".host.component.metric,.host.metric", "servers.web01.disk.used", opentsdb.TagSet{"host": "web01", "component": "disk", "metric": "used"}},
+		{".host.component.metric,.host.metric", "servers.web01.uptime", opentsdb.TagSet{"host": "web01", "metric": "uptime"}},
+		{".host.component.metric,.host.metric", "servers", nil},
+	}
+	for _, test := range tests {
+		f, err := parseGraphiteFormat(test.format)
+		if err != nil {
+			t.Errorf("%q: %v", test.format, err)
+			continue
+		}
+		tags, err := f.tags(test.target)
+		if test.tags == nil {
+			if err == nil {
+				t.Errorf("%q %q: expected error, got %v", test.format, test.target, tags)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q %q: %v", test.format, test.target, err)
+		} else if !tags.Equal(test.tags) {
+			t.Errorf("%q %q: expected %v, got %v", test.format, test.target, test.tags, tags)
+		}
+	}
+	for _, format := range []string{"x=host", "-1=host", "**.a.**", "**.2=host", "host:camel", "host?", "host?a b", "host,", ".x=host,host"} {
+		if _, err := parseGraphiteFormat(format); err == nil {
+			t.Errorf("%q: expected error", format)
+		}
+	}
+}
+
+func TestGraphiteFuncsParse(t *testing.T) {
+	for name, f := range Graphite {
+		args := make([]string, len(f.Args))
+		for i, a := range f.Args {
+			args[i] = `"host"`
+			if a == models.TypeScalar {
+				args[i] = "1"
+			}
+		}
+		expr := name + "(" + strings.Join(args, ", ") + ")"
+		if _, err := New(expr, Graphite); err != nil {
+			t.Errorf("%s: %v", expr, err)
+		}
+	}
+}
+
+func TestGraphiteFormatTaggedTags(t *testing.T) {
+	tests := []struct {
+		format string
+		target string
+		tags   opentsdb.TagSet // nil for error
+	}{
+		{"", "cpu;host=web01;dc=ny", opentsdb.TagSet{"name": "cpu", "host": "web01", "dc": "ny"}},
+		{"name.host", "disk.used;host=web01;dc=ny", opentsdb.TagSet{"name": "disk.used", "host": "web01"}},
+		{".host", "cpu;host=web01", opentsdb.TagSet{"host": "web01"}},
+		{"host.core", "cpu;host=web01", nil},
+		{"host:trim:lower", "cpu;host=WEB01", opentsdb.TagSet{"host": "web01"}},
+		{"dc.host,host", "cpu;host=web01", opentsdb.TagSet{"host": "web01"}},
+		{"dc.host,core", "cpu;host=web01", nil},
+	}
+	for _, test := range tests {
+		f, err := parseGraphiteFormat(test.format)
+		if err != nil {
+			t.Errorf("%q: %v", test.format, err)
+			continue
+		}
+		tagged, ok := parseGraphiteTaggedTarget(test.target)
+		if !ok {
+			t.Errorf("%q: expected a tagged series", test.target)
+			continue
+		}
+		tags, err := f.taggedTags(test.target, tagged)
+		if test.tags == nil {
+			if err == nil {
+				t.Errorf("%q %q: expected error, got %v", test.format, test.target, tags)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q %q: %v", test.format, test.target, err)
+		} else if !tags.Equal(test.tags) {
+			t.Errorf("%q %q: expected %v, got %v", test.format, test.target, test.tags, tags)
+		}
+	}
+}
+
+func TestGraphiteTagQuery(t *testing.T) {
+	tests := []struct {
+		query, format string
+		tags          parse.Tags
+	}{
+		{"collectd.*.cpu", "", parse.Tags{}},
+		{"collectd.*.cpu", ".host", parse.Tags{"host": struct{}{}}},
+		{"seriesByTag('name=cpu', 'host=*')", "", parse.Tags{}},
+		{"seriesByTag('name=cpu', 'host=*')", "name.host", parse.Tags{"name": struct{}{}, "host": struct{}{}}},
+		{"servers.*.**", ".host.component,.host", parse.Tags{"host": struct{}{}, "component": struct{}{}}},
+	}
+	for _, test := range tests {
+		args := []parse.Node{&parse.StringNode{Text: test.query}, nil, nil, &parse.StringNode{Text: test.format}}
+		tags, err := graphiteTagQuery(args)
+		if err != nil {
+			t.Errorf("%q %q: %v", test.query, test.format, err)
+		} else if !reflect.DeepEqual(tags, test.tags) {
+			t.Errorf("%q %q: expected %v, got %v", test.query, test.format, test.tags, tags)
+		}
+	}
+}
+
+func TestGraphiteTagQueryNotConstant(t *testing.T) {
+	for _, expr := range []string{
+		`graphite("*", "5m", "", graphiteRaw("*", "5m", ""))`,
+		`graphiteKeyed("*", "5m", "", graphiteRaw("*", "5m", ""))`,
+		`graphiteAllow("*", "5m", "", "host", graphiteRaw("*", "5m", ""), "drop")`,
+	} {
+		e, err := New(expr, Graphite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = e.Tree.Root.Tags()
+		if err == nil || !strings.Contains(err.Error(), "must be a constant string") {
+			t.Errorf("%s: expected an error about a constant string, got %v", expr, err)
+		}
+	}
+}
+
+func TestGraphiteFormatMismatchError(t *testing.T) {
+	f, err := parseGraphiteFormat("a.b.c.d.e")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.tags("x.y.z")
+	expected := `returned target 'x.y.z' does not match format 'a.b.c.d.e': target has 3 nodes ["x" "y" "z"] but format requires 5`
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+}
+
+func TestGraphiteEmptyResponseTTL(t *testing.T) {
+	c := &graphiteTestContext{}
+	e := graphiteTestState(c)
+	e.GraphiteConfig.State = NewGraphiteState()
+	e.GraphiteConfig.EmptyResponseTTL = time.Minute
+	for i := 0; i < 2; i++ {
+		if _, err := GraphiteQuery(e, "empty.ttl.test", "5m", "", ""); !IsNoData(err) {
+			t.Fatalf("expected no data error, got %v", err)
+		}
+		e.now = e.now.Add(time.Minute)
+	}
+	if len(c.reqs) != 1 {
+		t.Errorf("expected 1 request to graphite, got %d", len(c.reqs))
+	}
+	// the empty responses of one graphite aren't those of another
+	other := graphiteTestState(c)
+	other.GraphiteConfig = e.GraphiteConfig
+	other.GraphiteConfig.State = NewGraphiteState()
+	if _, err := GraphiteQuery(other, "empty.ttl.test", "5m", "", ""); !IsNoData(err) {
+		t.Fatalf("expected no data error, got %v", err)
+	}
+	if len(c.reqs) != 2 {
+		t.Errorf("expected a request to the other graphite, got %d", len(c.reqs))
+	}
+	if _, err := GraphiteBand(e, "empty.ttl.test", "5m", "1h", "", 2); !IsNoData(err) {
+		t.Errorf("expected no data error from band, got %v", err)
+	}
+	// absolute time ranges of the same length are different requests
+	c.reqs = nil
+	for _, start := range []float64{1000, 5000} {
+		if _, err := GraphiteAbsoluteQuery(e, "empty.ttl.test", start, start+300, ""); !IsNoData(err) {
+			t.Fatalf("expected no data error, got %v", err)
+		}
+	}
+	if len(c.reqs) != 2 {
+		t.Errorf("expected 2 absolute requests to graphite, got %d", len(c.reqs))
+	}
+	c.reqs = nil
+	for _, vars := range []string{"host=web01", "host=web02"} {
+		if _, err := GraphiteTemplateQuery(e, "template(empty.$host)", "5m", "", "", vars); !IsNoData(err) {
+			t.Fatalf("expected no data error, got %v", err)
+		}
+	}
+	if len(c.reqs) != 2 {
+		t.Errorf("expected a request to graphite for each template binding, got %d", len(c.reqs))
+	}
+	// graphiteNaN asks for the None datapoints that NoNullPoints leaves out
+	c.reqs = nil
+	e.GraphiteConfig.NoNullPoints = true
+	for _, query := range []func() (*Results, error){
+		func() (*Results, error) { return GraphiteQuery(e, "empty.none.test", "5m", "", "") },
+		func() (*Results, error) { return GraphiteNaNQuery(e, "empty.none.test", "5m", "", "") },
+	} {
+		if _, err := query(); !IsNoData(err) {
+			t.Fatalf("expected no data error, got %v", err)
+		}
+	}
+	if len(c.reqs) != 2 {
+		t.Errorf("expected a request to graphite with and without NoNullPoints, got %d", len(c.reqs))
+	}
+}
+
+func TestGraphiteResponses(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 900], [null, 960]]}
+	]`)}
+	e := graphiteTestState(c)
+	if _, err := GraphiteQuery(e, "*", "5m", "", "host"); err != nil {
+		t.Fatal(err)
+	}
+	expected := []GraphiteResponseSummary{{
+		Targets: []string{"*"},
+		Series:  []GraphiteSeriesSummary{{Target: "web01", Datapoints: 2, Nones: 1}},
+	}}
+	if got := e.GraphiteResponses(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+}
+
+func TestGraphiteNoneWarnRatio(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 900], [null, 960], [null, 1020]]},
+		{"target": "web02", "datapoints": [[1, 900], [2, 960], [null, 1020]]}
+	]`)}
+	e := graphiteTestState(c)
+	e.enableComputations = true
+	e.GraphiteConfig.NoneWarnRatio = .5
+	r, err := GraphiteQuery(e, "*", "5m", "", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range r.Results {
+		var expected models.Computations
+		if res.Group["host"] == "web01" {
+			expected = models.Computations{{Text: "graphite None datapoints", Value: "2 of 3"}}
+		}
+		if !reflect.DeepEqual(res.Computations, expected) {
+			t.Errorf("%v: expected computations %v, got %v", res.Group, expected, res.Computations)
+		}
+	}
+}
+
+func TestGraphiteBandMDP(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 601], [2, 725]]}
+	]`)}
+	r, err := GraphiteBandMDP(graphiteTestState(c), "*", "10m", "1m", "host", 2, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, req := range c.reqs {
+		if req.MaxDataPoints != 10 {
+			t.Errorf("expected MaxDataPoints 10, got %d", req.MaxDataPoints)
+		}
+	}
+	// 10m windows with 10 datapoints are aligned to 1m buckets
+	expected := Series{time.Unix(600, 0): 1, time.Unix(720, 0): 2}
+	if len(r.Results) != 1 || !r.Results[0].Value.(Series).Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, r.Results)
+	}
+}
+
+// graphiteWindowContext answers each request with a datapoint at its end
+// time. Windows ending at a multiple of 3 hours also return a second series.
+type graphiteWindowContext struct{}
+
+func (graphiteWindowContext) Query(r *graphite.Request) (graphite.Response, error) {
+	end := r.End.Unix()
+	resp := graphite.Response{{Target: "web01", Datapoints: []graphite.DataPoint{
+		{json.Number(fmt.Sprint(end)), json.Number(fmt.Sprint(end))},
+	}}}
+	if end%(3*3600) == 0 {
+		resp = append(resp, graphite.Series{Target: "web02", Datapoints: resp[0].Datapoints})
+	}
+	return resp, nil
+}
+
+func TestGraphiteBandSeconds(t *testing.T) {
+	e := graphiteTestState(graphiteWindowContext{})
+	e.now = time.Unix(10*3600, 0)
+	expected, err := GraphiteBand(e, "*", "30m", "1h", "host", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := GraphiteBandSeconds(e, "*", 1800, 3600, "host", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r.Results, expected.Results) {
+		t.Errorf("expected %v, got %v", expected.Results, r.Results)
+	}
+	for _, seconds := range [][2]float64{{0, 3600}, {1800, -3600}, {math.NaN(), 3600}, {1800, math.Inf(1)}, {1800, 400 * 24 * 3600}} {
+		if _, err := GraphiteBandSeconds(e, "*", seconds[0], seconds[1], "host", 5); err == nil {
+			t.Errorf("%v: expected error", seconds)
+		}
+	}
+}
+
+func TestGraphiteBandConcurrency(t *testing.T) {
+	var expected *Results
+	for _, concurrency := range []int{1, 3, 10} {
+		e := graphiteTestState(graphiteWindowContext{})
+		e.now = time.Unix(10*3600, 0)
+		e.GraphiteConfig.BandConcurrency = concurrency
+		r, err := GraphiteBand(e, "*", "30m", "1h", "host", 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(e.graphiteQueries) != 5 {
+			t.Errorf("concurrency %d: expected 5 queries, got %d", concurrency, len(e.graphiteQueries))
+		}
+		if expected == nil {
+			expected = r
+			if len(r.Results) != 2 || r.Results[0].Group["host"] != "web01" || len(r.Results[0].Value.(Series)) != 5 {
+				t.Fatalf("unexpected sequential band result %v", r.Results)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(r.Results, expected.Results) {
+			t.Errorf("concurrency %d: expected %v, got %v", concurrency, expected.Results, r.Results)
+		}
+	}
+}
+
+func TestGraphiteDecodeError(t *testing.T) {
+	tests := []struct {
+		datapoints []graphite.DataPoint
+		msg        string
+	}{
+		{[]graphite.DataPoint{{"1", "900"}, {"x", "960"}}, "value 'x' of datapoint 1 (timestamp 960) of target 'web01'"},
+		{[]graphite.DataPoint{{"1", "900"}, {"2", "960"}, {"3", "y"}}, "timestamp 'y' of datapoint 2 of target 'web01'"},
+	}
+	for _, test := range tests {
+		c := &graphiteTestContext{resp: graphite.Response{{Target: "web01", Datapoints: test.datapoints}}}
+		_, err := GraphiteQuery(graphiteTestState(c), "*", "5m", "", "host")
+		if err == nil || !strings.Contains(err.Error(), test.msg) {
+			t.Errorf("expected error containing %q, got %v", test.msg, err)
+		}
+	}
+}
+
+func TestGraphiteMaxSeries(t *testing.T) {
+	c := &graphiteTestContext{}
+	for _, host := range []string{"web01", "web02", "web03"} {
+		c.resp = append(c.resp, graphite.Series{Target: host, Datapoints: []graphite.DataPoint{{"1", "900"}}})
+	}
+	e := graphiteTestState(c)
+	e.GraphiteConfig.MaxSeries = 2
+	e.GraphiteConfig.Retries = 2
+	_, err := GraphiteQuery(e, "web*", "5m", "", "host")
+	if err == nil || !strings.Contains(err.Error(), "matched more than 2 series, limit is 2") {
+		t.Errorf("expected series limit error, got %v", err)
+	}
+	if len(c.reqs) != 1 {
+		t.Errorf("expected the query not to be retried, got %d requests", len(c.reqs))
+	}
+	e.GraphiteConfig.MaxSeries = 3
+	r, err := GraphiteQuery(e, "web*", "5m", "", "host")
+	if err != nil || len(r.Results) != 3 {
+		t.Errorf("expected 3 results, got %v %v", r, err)
+	}
+}
+
+// graphiteBlockingContext is a graphite.Context whose queries only return
+// once they are cancelled.
+type graphiteBlockingContext struct{}
+
+func (graphiteBlockingContext) Query(r *graphite.Request) (graphite.Response, error) {
+	return nil, fmt.Errorf("graphite unavailable")
+}
+
+func (graphiteBlockingContext) QueryContext(ctx context.Context, r *graphite.Request) (graphite.Response, error) {
+	<-ctx.Done()
+	return graphite.Response{{Target: "partial"}}, ctx.Err()
+}
+
+func TestGraphiteContextCancel(t *testing.T) {
+	e := graphiteTestState(graphiteBlockingContext{})
+	e.Cache = cache.New("test", 10)
+	e.GraphiteConfig.Retries = 3
+	e.GraphiteConfig.RetryBackoff = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	e.ctx = ctx
+	time.AfterFunc(10*time.Millisecond, cancel)
+	done := make(chan error)
+	go func() {
+		_, err := GraphiteQuery(e, "*", "5m", "", "host")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected error for cancelled query")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("query was not cancelled")
+	}
+	// the aborted query is not cached
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[{"target": "web01", "datapoints": [[1, 900]]}]`)}
+	e.GraphiteContext = c
+	e.ctx = nil
+	if _, err := GraphiteQuery(e, "*", "5m", "", "host"); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.reqs) != 1 {
+		t.Errorf("expected the query to be sent again, got %d requests", len(c.reqs))
+	}
+}
+
+func TestGraphiteStrictTimestamps(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 900], [2, 900]]}
+	]`)}
+	e := graphiteTestState(c)
+	r, err := GraphiteQuery(e, "*", "5m", "", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v := r.Results[0].Value.(Series)[time.Unix(900, 0)]; v != 2 {
+		t.Errorf("expected the last datapoint to win, got %v", v)
+	}
+	e = graphiteTestState(c)
+	e.GraphiteConfig.StrictTimestamps = true
+	_, err = GraphiteQuery(e, "*", "5m", "", "host")
+	if err == nil || !strings.Contains(err.Error(), "more than one datapoint at timestamp 900") {
+		t.Errorf("expected duplicate timestamp error, got %v", err)
+	}
+}
+
+func TestGraphiteConsolidateByQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[{"target": "web01", "datapoints": [[1, 900]]}]`)}
+	if _, err := GraphiteConsolidateByQuery(graphiteTestState(c), "*", "5m", "", "host", "max"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GraphiteConsolidateByQuery(graphiteTestState(c), "*", "5m", "", "host", ""); err != nil {
+		t.Fatal(err)
+	}
+	if c.reqs[0].ConsolidateBy != "max" || c.reqs[1].ConsolidateBy != "" {
+		t.Errorf("unexpected consolidation functions %q and %q", c.reqs[0].ConsolidateBy, c.reqs[1].ConsolidateBy)
+	}
+	if _, err := GraphiteConsolidateByQuery(graphiteTestState(c), "*", "5m", "", "host", "median"); err == nil {
+		t.Error("expected error for unknown consolidation function")
+	}
+}
+
+// graphiteExpandContext expands every query to its paths.
+type graphiteExpandContext struct {
+	graphiteTestContext
+	paths []string
+}
+
+func (c *graphiteExpandContext) Expand(ctx context.Context, r *graphite.ExpandRequest) ([]string, error) {
+	return c.paths, nil
+}
+
+func TestGraphiteExpand(t *testing.T) {
+	c := &graphiteExpandContext{paths: []string{"app.web01.hits", "app.web02.hits"}}
+	r, err := GraphiteExpand(graphiteTestState(c), "app.*.hits", ".host.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Results) != 2 {
+		t.Fatalf("expected 2 results, got %v", r.Results)
+	}
+	expected := opentsdb.TagSet{"host": "web02", TargetTag: "app.web02.hits"}
+	if !r.Results[1].Group.Equal(expected) || r.Results[1].Value != Number(1) {
+		t.Errorf("expected %v with 1, got %v with %v", expected, r.Results[1].Group, r.Results[1].Value)
+	}
+	if _, err := GraphiteExpand(graphiteTestState(c), "app.*.hits", "..metric"); err == nil {
+		t.Error("expected an error for a format giving both paths the same tags")
+	}
+}
+
+// graphiteEventsContext answers events requests with events and records
+// them.
+type graphiteEventsContext struct {
+	graphiteTestContext
+	events []graphite.Event
+	ereqs  []*graphite.EventsRequest
+}
+
+func (c *graphiteEventsContext) Events(ctx context.Context, r *graphite.EventsRequest) ([]graphite.Event, error) {
+	c.ereqs = append(c.ereqs, r)
+	return c.events, nil
+}
+
+func TestGraphiteEvents(t *testing.T) {
+	c := &graphiteEventsContext{events: []graphite.Event{
+		{When: 900, What: "deploy api", Tags: graphite.EventTags{"deploy", "api"}},
+		{When: 950, What: "deploy web", Tags: graphite.EventTags{"deploy", "web server"}},
+		{When: 960, What: "untagged"},
+	}}
+	r, err := GraphiteEvents(graphiteTestState(c), "deploy", "5m", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.ereqs) != 1 || !reflect.DeepEqual(c.ereqs[0].Tags, []string{"deploy"}) || c.ereqs[0].Start.Unix() != 700 {
+		t.Errorf("unexpected events request %+v", c.ereqs)
+	}
+	values := make(map[string]Series)
+	for _, res := range r.Results {
+		values[res.Group[graphiteEventTag]] = res.Value.(Series)
+	}
+	expected := map[string]Series{
+		"api":        {time.Unix(900, 0): 1},
+		"deploy":     {time.Unix(900, 0): 1, time.Unix(950, 0): 1},
+		"web_server": {time.Unix(950, 0): 1},
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %v, got %v", expected, values)
+	}
+}
+
+func TestGraphiteImprecise(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[9007199254740993, 900], [9007199254740994, 910], [1e300, 920], [1.5, 930]]},
+		{"target": "web02", "datapoints": [[9007199254740992, 900]]}
+	]`)}
+	e := graphiteTestState(c)
+	e.enableComputations = true
+	r, err := GraphiteQuery(e, "*", "5m", "", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range r.Results {
+		var warned string
+		for _, comp := range res.Computations {
+			if comp.Text == "graphite imprecise datapoints" {
+				warned = fmt.Sprint(comp.Value)
+			}
+		}
+		switch host := res.Group["host"]; {
+		case host == "web01" && !strings.HasPrefix(warned, "1 of 4 "):
+			t.Errorf("expected a warning for one datapoint of web01, got %q", warned)
+		case host == "web02" && warned != "":
+			t.Errorf("expected no warning for web02, got %q", warned)
+		}
+	}
+	for n, expected := range map[string]bool{
+		"9007199254740993":             true,
+		"-9007199254740993":            true,
+		"1" + strings.Repeat("0", 400): true,
+		"9007199254740992":             false,
+		"1e300":                        false,
+	} {
+		v, _ := graphiteValue(json.Number(n))
+		if got := graphiteImprecise(json.Number(n), v); got != expected {
+			t.Errorf("%.20s: expected imprecise %v, got %v", n, expected, got)
+		}
+	}
+}
+
+func TestGraphiteLastAgeQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 900], [2, 940], [null, 980]]},
+		{"target": "web02", "datapoints": [[null, 900]]}
+	]`)}
+	for empty, check := range map[string]func(float64) bool{
+		"window": func(v float64) bool { return v == 300 },
+		"nan":    math.IsNaN,
+	} {
+		r, err := GraphiteLastAgeQuery(graphiteTestState(c), "*", "5m", "", "host", empty)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := make(map[string]float64)
+		for _, res := range r.Results {
+			values[res.Group["host"]] = float64(res.Value.(Number))
+		}
+		if values["web01"] != 60 || !check(values["web02"]) {
+			t.Errorf("%s: unexpected ages %v", empty, values)
+		}
+	}
+	if _, err := GraphiteLastAgeQuery(graphiteTestState(c), "*", "5m", "", "host", "zero"); err == nil {
+		t.Error("expected error for unknown empty mode")
+	}
+}
+
+func TestGraphiteFilterQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[9, 900], [1, 940]]},
+		{"target": "web02", "datapoints": [[1, 900], [5, 940]]},
+		{"target": "web03", "datapoints": [[1, 900], [9, 940]]},
+		{"target": "web04", "datapoints": []}
+	]`)}
+	for op, want := range map[string]string{
+		"gt": "web03",
+		"ge": "web02 web03",
+		"lt": "web01",
+		"le": "web01 web02",
+	} {
+		r, err := GraphiteFilterQuery(graphiteTestState(c), "*", "5m", "", "host", op, 5)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var hosts []string
+		for _, res := range r.Results {
+			hosts = append(hosts, res.Group["host"])
+		}
+		sort.Strings(hosts)
+		if got := strings.Join(hosts, " "); got != want {
+			t.Errorf("%s: expected %s, got %s", op, want, got)
+		}
+	}
+	if _, err := GraphiteFilterQuery(graphiteTestState(c), "*", "5m", "", "host", "eq", 5); err == nil {
+		t.Error("expected error for unknown op")
+	}
+}
+
+func TestGraphiteGapsQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[null, 900], [1, 910], [null, 920], [null, 930], [4, 940], [null, 950]]},
+		{"target": "web02", "datapoints": [[1, 900], [2, 910]]},
+		{"target": "web03", "datapoints": [[null, 900], [null, 910]]}
+	]`)}
+	e := graphiteTestState(c)
+	e.GraphiteConfig.NoNullPoints = true
+	r, err := GraphiteGapsQuery(e, "*", "5m", "", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.reqs[0].NoNullPoints {
+		t.Error("expected graphite to return None datapoints")
+	}
+	values := make(map[string]float64)
+	for _, res := range r.Results {
+		values[res.Group["host"]] = float64(res.Value.(Number))
+	}
+	if expected := map[string]float64{"web01": 3, "web02": 0, "web03": 1}; !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected gaps %v, got %v", expected, values)
+	}
+}
+
+func TestGraphiteNullRatioQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 900], [null, 910], [null, 920], [4, 930]]},
+		{"target": "web02", "datapoints": [[null, 900]]},
+		{"target": "web03", "datapoints": []},
+		{"target": "web04", "datapoints": [[1, 900], [null, 900], [3, 910], [4, 920]]}
+	]`)}
+	e := graphiteTestState(c)
+	e.GraphiteConfig.NoNullPoints = true
+	r, err := GraphiteNullRatioQuery(e, "*", "5m", "", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.reqs[0].NoNullPoints {
+		t.Error("expected graphite to return None datapoints")
+	}
+	values := make(map[string]float64)
+	for _, res := range r.Results {
+		values[res.Group["host"]] = float64(res.Value.(Number))
+	}
+	// the datapoints at the same timestamp of web04 are counted apart
+	if values["web01"] != 0.5 || values["web02"] != 1 || !math.IsNaN(values["web03"]) || values["web04"] != 0.25 {
+		t.Errorf("unexpected null ratios %v", values)
+	}
+}
+
+func TestGraphiteRateQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[10, 900], [20, 910], [null, 920], [5, 930], [15, 940]]}
+	]`)}
+	nan := math.NaN()
+	tests := []struct {
+		negative, gaps string
+		expected       map[int64]float64
+	}{
+		{"keep", "skip", map[int64]float64{910: 1, 930: -0.75, 940: 1}},
+		{"zero", "skip", map[int64]float64{910: 1, 930: 0, 940: 1}},
+		{"keep", "nan", map[int64]float64{910: 1, 920: nan, 930: nan, 940: 1}},
+	}
+	for _, test := range tests {
+		r, err := GraphiteRateQuery(graphiteTestState(c), "*", "5m", "", "host", test.negative, test.gaps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := r.Results[0].Value.(Series)
+		if len(s) != len(test.expected) {
+			t.Errorf("%s %s: expected %v, got %v", test.negative, test.gaps, test.expected, s)
+			continue
+		}
+		for ts, v := range test.expected {
+			got, ok := s[time.Unix(ts, 0)]
+			if !ok || got != v && !(math.IsNaN(got) && math.IsNaN(v)) {
+				t.Errorf("%s %s: expected %v at %d, got %v", test.negative, test.gaps, v, ts, s)
+			}
+		}
+	}
+	if _, err := GraphiteRateQuery(graphiteTestState(c), "*", "5m", "", "host", "abs", "skip"); err == nil {
+		t.Error("expected error for unknown negative mode")
+	}
+	if _, err := GraphiteRateQuery(graphiteTestState(c), "*", "5m", "", "host", "keep", "fill"); err == nil {
+		t.Error("expected error for unknown gaps mode")
+	}
+}
+
+func TestGraphiteMovingAvgQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 900], [2, 910], [null, 915], [3, 920], [4, 930], [8, 940]]}
+	]`)}
+	tests := []struct {
+		window, leading string
+		expected        map[int64]float64
+	}{
+		{"3", "omit", map[int64]float64{920: 2, 930: 3, 940: 5}},
+		{"3", "partial", map[int64]float64{900: 1, 910: 1.5, 920: 2, 930: 3, 940: 5}},
+		{"30s", "omit", map[int64]float64{920: 2, 930: 3, 940: 5}},
+		{"1", "omit", map[int64]float64{900: 1, 910: 2, 920: 3, 930: 4, 940: 8}},
+	}
+	for _, test := range tests {
+		r, err := GraphiteMovingAvgQuery(graphiteTestState(c), "*", "5m", "", "host", test.window, test.leading)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := r.Results[0].Value.(Series)
+		if len(s) != len(test.expected) {
+			t.Errorf("%s %s: expected %v, got %v", test.window, test.leading, test.expected, s)
+			continue
+		}
+		for ts, v := range test.expected {
+			if got, ok := s[time.Unix(ts, 0)]; !ok || got != v {
+				t.Errorf("%s %s: expected %v at %d, got %v", test.window, test.leading, v, ts, s)
+			}
+		}
+	}
+	for _, window := range []string{"0", "-1m", "soon"} {
+		if _, err := GraphiteMovingAvgQuery(graphiteTestState(c), "*", "5m", "", "host", window, "omit"); err == nil {
+			t.Errorf("expected error for window %q", window)
+		}
+	}
+	if _, err := GraphiteMovingAvgQuery(graphiteTestState(c), "*", "5m", "", "host", "3", "zero"); err == nil {
+		t.Error("expected error for unknown leading mode")
+	}
+}
+
+func TestGraphiteInterpolateQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[null, 880], [10, 900], [null, 920], [null, 940], [40, 960], [50, 980], [null, 1000]]}
+	]`)}
+	r, err := GraphiteInterpolateQuery(graphiteTestState(c), "*", "5m", "", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := r.Results[0].Value.(Series)
+	expected := map[int64]float64{900: 10, 920: 20, 940: 30, 960: 40, 980: 50}
+	if len(s) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, s)
+	}
+	for ts, v := range expected {
+		if got, ok := s[time.Unix(ts, 0)]; !ok || got != v {
+			t.Errorf("expected %v at %d, got %v", v, ts, s)
+		}
+	}
+}
+
+func TestGraphiteFlatlineQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[3, 900], [null, 960], [3, 1020]]},
+		{"target": "web02", "datapoints": [[3, 900], [4, 960]]},
+		{"target": "web03", "datapoints": [[null, 900], [null, 960]]}
+	]`)}
+	r, err := GraphiteFlatlineQuery(graphiteTestState(c), "*", "5m", "", "host", "unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, res := range r.Results {
+		values[res.Group["host"]] = float64(res.Value.(Number))
+	}
+	if values["web01"] != 1 || values["web02"] != 0 || !math.IsNaN(values["web03"]) {
+		t.Errorf("unexpected flatline values %v", values)
+	}
+	if _, err := GraphiteFlatlineQuery(graphiteTestState(c), "*", "5m", "", "host", "nope"); err == nil {
+		t.Error("expected error for unknown empty mode")
+	}
+}
+
+func TestGraphiteSourceTag(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[{"target": "web01", "datapoints": [[1, 900]]}]`)}
+	e := graphiteTestState(c)
+	r, err := GraphiteQuery(e, "*", "5m", "", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.Results[0].Group["cluster"]; ok {
+		t.Errorf("expected no source tag by default, got %v", r.Results[0].Group)
+	}
+	e = graphiteTestState(c)
+	e.GraphiteConfig.SourceTag, e.GraphiteConfig.Source = "cluster", "ny"
+	r, err = GraphiteQuery(e, "*", "5m", "", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := opentsdb.TagSet{"host": "web01", "cluster": "ny"}
+	if !r.Results[0].Group.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, r.Results[0].Group)
+	}
+}
+
+func TestGraphiteRequestHeader(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[{"target": "web01", "datapoints": [[1, 900]]}]`)}
+	e := graphiteTestState(c)
+	e.Origin = "Schedule: Alert Name: cpu"
+	if _, err := GraphiteQuery(e, "*", "5m", "", "host"); err != nil {
+		t.Fatal(err)
+	}
+	e.GraphiteConfig.UserAgent, e.GraphiteConfig.OriginHeader = "bosun-test", "X-Bosun-Origin"
+	if _, err := GraphiteQuery(e, "*", "5m", "", "host"); err != nil {
+		t.Fatal(err)
+	}
+	if c.reqs[0].Header != nil {
+		t.Errorf("expected no headers by default, got %v", c.reqs[0].Header)
+	}
+	h := c.reqs[1].Header
+	if h.Get("User-Agent") != "bosun-test" || h.Get("X-Bosun-Origin") != e.Origin {
+		t.Errorf("unexpected headers %v", h)
+	}
+}
+
+// graphiteNoNullContext is a graphiteTestContext that leaves out None
+// datapoints, and series that only have None datapoints, like graphite does
+// for requests with noNullPoints.
+type graphiteNoNullContext struct {
+	graphiteTestContext
+}
+
+func (c *graphiteNoNullContext) Query(r *graphite.Request) (graphite.Response, error) {
+	resp, err := c.graphiteTestContext.Query(r)
+	if err != nil || !r.NoNullPoints {
+		return resp, err
+	}
+	var kept graphite.Response
+	for _, s := range resp {
+		var dps []graphite.DataPoint
+		for _, dp := range s.Datapoints {
+			if dp[0] != "" {
+				dps = append(dps, dp)
+			}
+		}
+		if len(dps) > 0 {
+			kept = append(kept, graphite.Series{Target: s.Target, Datapoints: dps})
+		}
+	}
+	return kept, nil
+}
+
+func TestGraphiteNoNullPoints(t *testing.T) {
+	c := &graphiteNoNullContext{}
+	c.resp = graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 900], [null, 960]]},
+		{"target": "web02", "datapoints": [[null, 900], [null, 960]]}
+	]`)
+	e := graphiteTestState(c)
+	count := func(r *Results) int {
+		n := 0
+		for _, res := range r.Results {
+			if res.Group["host"] == "web02" {
+				if s := res.Value.(Series); len(s) != 0 {
+					t.Errorf("expected no datapoints for web02, got %v", s)
+				}
+				n++
+			}
+		}
+		return n
+	}
+	// skipping None datapoints keeps the series without datapoints
+	r, err := GraphiteQuery(e, "*", "5m", "", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Results) != 2 || count(r) != 1 {
+		t.Errorf("expected web02 without datapoints, got %v", r.Results)
+	}
+	// but with NoNullPoints graphite doesn't return it at all
+	e.GraphiteConfig.NoNullPoints = true
+	if r, err = GraphiteQuery(e, "*", "5m", "", "host"); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Results) != 1 || count(r) != 0 {
+		t.Errorf("expected only web01 with NoNullPoints, got %v", r.Results)
+	}
+	if r, err = GraphiteNaNQuery(e, "*", "5m", "", "host"); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Results) != 2 {
+		t.Errorf("expected graphiteNaN to keep web02, got %v", r.Results)
+	}
+	if c.reqs[0].NoNullPoints || !c.reqs[1].NoNullPoints || c.reqs[2].NoNullPoints {
+		t.Errorf("expected only the query skipping None datapoints to use noNullPoints")
+	}
+}
+
+func TestGraphiteParseErrorTargets(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "sumSeries(app.*.hits)", "datapoints": [[1, 900]]}
+	]`)}
+	_, err := GraphiteQuery(graphiteTestState(c), "sumSeries(app.{web,api}*.hits)", "5m", "", "a.b.c.host")
+	if err == nil || !strings.Contains(err.Error(), "graphite ParseError for sumSeries(app.{web,api}*.hits) (") {
+		t.Errorf("expected the target pattern in the error, got %v", err)
+	}
+}
+
+// graphiteBrokenWindowContext is a graphiteWindowContext that fails the
+// windows ending at the given times.
+type graphiteBrokenWindowContext map[int64]bool
+
+func (c graphiteBrokenWindowContext) Query(r *graphite.Request) (graphite.Response, error) {
+	if c[r.End.Unix()] {
+		return nil, fmt.Errorf("graphite unavailable")
+	}
+	return graphiteWindowContext{}.Query(r)
+}
+
+func TestSnapGraphiteTime(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*3600)
+	// Thursday 2018-03-15 10:20 in loc
+	ts := time.Date(2018, 3, 15, 10, 20, 0, 0, loc).UTC()
+	tests := map[string]time.Time{
+		"hour": time.Date(2018, 3, 15, 10, 0, 0, 0, loc),
+		"day":  time.Date(2018, 3, 15, 0, 0, 0, 0, loc),
+		"week": time.Date(2018, 3, 12, 0, 0, 0, 0, loc),
+	}
+	for anchor, expected := range tests {
+		if got := snapGraphiteTime(ts, anchor, loc); !got.Equal(expected) {
+			t.Errorf("%s: expected %v, got %v", anchor, expected, got)
+		}
+	}
+}
+
+func TestGraphiteBandCalendar(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 900]]}
+	]`)}
+	e := graphiteTestState(c)
+	e.now = time.Unix(10*86400+3600+1200, 0) // 01:20
+	e.GraphiteConfig.BandConcurrency = 1
+	if _, err := graphiteBand(e, "*", "1h", "1d", "host", 2, graphiteBandOptions{anchor: "hour", loc: time.UTC}); err != nil {
+		t.Fatal(err)
+	}
+	// the windows start at 00:20 on the previous days, moved back to 00:00
+	for i, req := range c.reqs {
+		start := int64(10-i-1) * 86400
+		if req.Start.Unix() != start || req.End.Unix() != start+3600 {
+			t.Errorf("window %d: expected %d to %d, got %d to %d", i, start, start+3600, req.Start.Unix(), req.End.Unix())
+		}
+	}
+	if _, err := GraphiteBandCalendar(e, "*", "1h", "1d", "host", 2, "month"); err == nil {
+		t.Error("expected error for unknown anchor")
+	}
+	c.reqs = nil
+	if _, err := GraphiteBandCalendarTZ(e, "*", "1h", "1d", "host", 1, "day", "UTC"); err != nil {
+		t.Fatal(err)
+	}
+	if req := c.reqs[0]; req.Location != time.UTC || req.Start.Unix() != 9*86400 {
+		t.Errorf("expected a UTC window starting at %d, got %v from %d", 9*86400, req.Location, req.Start.Unix())
+	}
+	if _, err := GraphiteBandCalendarTZ(e, "*", "1h", "1d", "host", 1, "day", "Not/AZone"); err == nil {
+		t.Error("expected error for unknown time zone")
+	}
+}
+
+func TestGraphiteBandJitter(t *testing.T) {
+	ends := func(origin string) []int64 {
+		c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+			{"target": "web01", "datapoints": [[1, 900]]}
+		]`)}
+		e := graphiteTestState(c)
+		e.now = time.Unix(10*3600, 0)
+		e.Origin = origin
+		e.GraphiteConfig.BandJitter = 5 * time.Minute
+		e.GraphiteConfig.BandConcurrency = 1
+		if _, err := GraphiteBand(e, "*", "30m", "1h", "host", 3); err != nil {
+			t.Fatal(err)
+		}
+		var ends []int64
+		for _, req := range c.reqs {
+			ends = append(ends, req.End.Unix())
+		}
+		return ends
+	}
+	a := ends("Schedule: Alert Name: a")
+	if !reflect.DeepEqual(a, ends("Schedule: Alert Name: a")) {
+		t.Error("expected the same windows for the same rule")
+	}
+	jitter := 9*3600 - a[0]
+	if jitter < 0 || jitter >= 300 {
+		t.Errorf("expected jitter below 5m, got %ds", jitter)
+	}
+	for i := range a {
+		if a[i] != 9*3600-int64(i)*3600-jitter {
+			t.Errorf("expected window %d to be an hour after the next, got %v", i, a)
+		}
+	}
+	if reflect.DeepEqual(a, ends("Schedule: Alert Name: b")) {
+		t.Error("expected different windows for different rules")
+	}
+}
+
+// graphiteResolutionContext returns windows ending before cutoff at a 5m
+// resolution and later ones at 1m.
+type graphiteResolutionContext struct{ cutoff int64 }
+
+func (c graphiteResolutionContext) Query(r *graphite.Request) (graphite.Response, error) {
+	step := int64(60)
+	if r.End.Unix() < c.cutoff {
+		step = 300
+	}
+	var dps []graphite.DataPoint
+	for t := r.Start.Unix(); t < r.End.Unix(); t += step {
+		dps = append(dps, graphite.DataPoint{"1", json.Number(fmt.Sprint(t))})
+	}
+	return graphite.Response{{Target: "web01", Datapoints: dps}}, nil
+}
+
+// graphiteMDPContext returns 1m datapoints, consolidated like graphite does
+// to at most maxDataPoints unless ignore is set.
+type graphiteMDPContext struct {
+	ignore bool
+	mdps   []int
+}
+
+func (c *graphiteMDPContext) Query(r *graphite.Request) (graphite.Response, error) {
+	c.mdps = append(c.mdps, r.MaxDataPoints)
+	step := int64(60)
+	if n := (r.End.Unix() - r.Start.Unix()) / step; r.MaxDataPoints > 0 && !c.ignore && n > int64(r.MaxDataPoints) {
+		step *= (n + int64(r.MaxDataPoints) - 1) / int64(r.MaxDataPoints)
+	}
+	var dps []graphite.DataPoint
+	for t := r.Start.Unix(); t < r.End.Unix(); t += step {
+		dps = append(dps, graphite.DataPoint{"1", json.Number(fmt.Sprint(t))})
+	}
+	return graphite.Response{{Target: "web01", Datapoints: dps}}, nil
+}
+
+func TestGraphiteBestResolutionQuery(t *testing.T) {
+	for limit, expected := range map[float64][]int{100: {0}, 20: {0, 20}} {
+		c := &graphiteMDPContext{}
+		e := graphiteTestState(c)
+		e.now = time.Unix(3600, 0)
+		r, err := GraphiteBestResolutionQuery(e, "*", "1h", "", "host", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c.mdps, expected) {
+			t.Errorf("limit %v: expected maxDataPoints %v, got %v", limit, expected, c.mdps)
+		}
+		if n := len(r.Results[0].Value.(Series)); n > int(limit) {
+			t.Errorf("limit %v: got %d datapoints", limit, n)
+		}
+	}
+	c := &graphiteMDPContext{ignore: true}
+	e := graphiteTestState(c)
+	e.now = time.Unix(3600, 0)
+	if _, err := GraphiteBestResolutionQuery(e, "*", "1h", "", "host", 20); err == nil {
+		t.Error("expected error when graphite ignores maxDataPoints")
+	}
+	if expected := []int{0, 20, 10, 5}; !reflect.DeepEqual(c.mdps, expected) {
+		t.Errorf("expected maxDataPoints %v, got %v", expected, c.mdps)
+	}
+}
+
+func TestGraphiteBandResolutions(t *testing.T) {
+	for cutoff, expected := range map[int64]string{0: "", 8 * 3600: "[1m0s 5m0s]"} {
+		e := graphiteTestState(graphiteResolutionContext{cutoff})
+		e.now = time.Unix(10*3600, 0)
+		e.enableComputations = true
+		r, err := GraphiteBand(e, "*", "30m", "1h", "host", 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got string
+		for _, c := range r.Results[0].Computations {
+			if c.Text == "graphiteBand mixed resolutions" {
+				got = c.Value.(string)
+			}
+		}
+		if got != expected {
+			t.Errorf("cutoff %d: expected resolutions %q, got %q", cutoff, expected, got)
+		}
+	}
+}
+
+func TestGraphiteBandStats(t *testing.T) {
+	e := graphiteTestState(graphiteWindowContext{})
+	e.now = time.Unix(10*3600, 0)
+	// the windows of web01 end at 9h, 8h, 7h and 6h with their end as value
+	expected := map[string]Number{"avg": 7.5 * 3600, "dev": Number(math.Sqrt(5.0/3) * 3600)}
+	for stat, want := range expected {
+		r, err := GraphiteBandStats(e, "*", "30m", "1h", "host", 4, stat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range r.Results {
+			if res.Group["host"] != "web01" {
+				continue
+			}
+			if v := res.Value.(Number); math.Abs(float64(v-want)) > 1e-6 {
+				t.Errorf("%s: expected %v, got %v", stat, want, v)
+			}
+		}
+	}
+	if _, err := GraphiteBandStats(e, "*", "30m", "1h", "host", 4, "median"); err == nil {
+		t.Error("expected error for unknown stat")
+	}
+}
+
+func TestGraphiteBandSeparate(t *testing.T) {
+	e := graphiteTestState(graphiteWindowContext{})
+	e.now = time.Unix(10*3600, 0)
+	r, err := GraphiteBandSeparate(e, "*", "30m", "1h", "host", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the windows end at 9h, 8h, 7h and 6h and are all moved to end at 10h
+	values := make(map[string]float64)
+	for _, res := range r.Results {
+		s := res.Value.(Series)
+		if len(s) != 1 {
+			t.Fatalf("%v: expected 1 datapoint, got %v", res.Group, s)
+		}
+		values[res.Group.String()] = s[time.Unix(10*3600, 0)]
+	}
+	expected := map[string]float64{
+		"{band=0,host=web01}": 9 * 3600,
+		"{band=1,host=web01}": 8 * 3600,
+		"{band=2,host=web01}": 7 * 3600,
+		"{band=3,host=web01}": 6 * 3600,
+		"{band=0,host=web02}": 9 * 3600,
+		"{band=3,host=web02}": 6 * 3600,
+	}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected %v, got %v", expected, values)
+	}
+	if _, err := graphiteBandSeparateTags([]parse.Node{nil, nil, nil, &parse.StringNode{Text: "host.band"}}); err == nil {
+		t.Error("expected error for a format with a band tag")
+	}
+}
+
+func TestGraphiteBandPartial(t *testing.T) {
+	c := graphiteBrokenWindowContext{8 * 3600: true, 6 * 3600: true}
+	e := graphiteTestState(c)
+	e.now = time.Unix(10*3600, 0)
+	e.enableComputations = true
+	if _, err := GraphiteBandPartial(e, "*", "30m", "1h", "host", 5, 1); err == nil {
+		t.Error("expected error with more failed windows than allowed")
+	}
+	r, err := GraphiteBandPartial(e, "*", "30m", "1h", "host", 5, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := r.Results[0].Value.(Series); len(s) != 3 {
+		t.Errorf("expected datapoints of 3 windows, got %v", s)
+	}
+	cs := r.Results[0].Computations
+	if len(cs) != 1 || cs[0].Value != 2 {
+		t.Errorf("expected 2 dropped windows to be recorded, got %v", cs)
+	}
+	if _, err := GraphiteBandPartial(e, "*", "30m", "2h", "host", 2, 2); err == nil {
+		t.Error("expected error when all windows failed")
+	}
+}
+
+func TestGraphiteNaNQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 900], [null, 960], [3, 1020]]}
+	]`)}
+	r, err := GraphiteNaNQuery(graphiteTestState(c), "*", "5m", "", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := r.Results[0].Value.(Series)
+	if len(s) != 3 || !math.IsNaN(s[time.Unix(960, 0)]) || s[time.Unix(1020, 0)] != 3 {
+		t.Errorf("expected None to be NaN, got %v", s)
+	}
+}
+
+func TestGraphiteZeroQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[null, 900], [2, 960], [null, 1020]]}
+	]`)}
+	r, err := GraphiteZeroQuery(graphiteTestState(c), "*", "5m", "", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Series{time.Unix(900, 0): 0, time.Unix(960, 0): 2, time.Unix(1020, 0): 0}
+	if s := r.Results[0].Value.(Series); !s.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, s)
+	}
+}
+
+func TestGraphiteNaNTrimQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[null, 840], [null, 900], [1, 960], [null, 1020], [3, 1080]]}
+	]`)}
+	r, err := GraphiteNaNTrimQuery(graphiteTestState(c), "*", "5m", "", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := r.Results[0].Value.(Series)
+	if _, ok := s[time.Unix(900, 0)]; ok || len(s) != 3 {
+		t.Errorf("expected leading None to be dropped, got %v", s)
+	}
+	if !math.IsNaN(s[time.Unix(1020, 0)]) || s[time.Unix(960, 0)] != 1 {
+		t.Errorf("expected interior None to be NaN, got %v", s)
+	}
+}
+
+func TestGraphiteTaggedQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "disk.used;host=web01", "tags": {"name": "disk.used", "host": "web01"}, "datapoints": [[1, 900]]},
+		{"target": "web02.disk", "datapoints": [[2, 900]]},
+		{"target": "cpu;host=web03;metric=cpu", "datapoints": [[3, 900]]}
+	]`)}
+	r, err := GraphiteTaggedQuery(graphiteTestState(c), "*", "5m", "", "host.metric")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []opentsdb.TagSet{
+		{"name": "disk.used", "host": "web01"},
+		{"host": "web02", "metric": "disk"},
+		{"host": "web03", "metric": "cpu"},
+	}
+	if len(r.Results) != len(expected) {
+		t.Fatalf("expected %d results, got %d", len(expected), len(r.Results))
+	}
+	for i, res := range r.Results {
+		if !res.Group.Equal(expected[i]) {
+			t.Errorf("expected tags %v, got %v", expected[i], res.Group)
+		}
+	}
+	// graphite splits names with tags into nodes like any other
+	c.resp = graphiteTestResponse(t, `[{"target": "servers.web04.cpu;dc=ny", "datapoints": [[4, 900]]}]`)
+	r, err = GraphiteQuery(graphiteTestState(c), "*", "5m", "", ".host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g := r.Results[0].Group; !g.Equal(opentsdb.TagSet{"host": "web04"}) {
+		t.Errorf("expected the format to give the tags, got %v", g)
+	}
+}
+
+func TestValidateGraphiteQuery(t *testing.T) {
+	tests := []struct {
+		query, format string
+		tags          string
+		errs          int
+	}{
+		{"web*.cpu", "host.metric", "host,metric", 0},
+		{"sumSeries(a.{b,c})", "", "", 0},
+		{"sumSeries(a.b", "host", "host", 1},
+		{"a.b)", "host", "host", 1},
+		{"aliasSub(a, 'x", "host", "host", 1},
+		{"", "host.ho st", "", 2},
+		{"a.b", "host.host", "", 1},
+		{"a.b", "x=host", "", 1},
+	}
+	for _, test := range tests {
+		tags, errs := ValidateGraphiteQuery(test.query, test.format)
+		if len(errs) != test.errs {
+			t.Errorf("%q %q: expected %d errors, got %v", test.query, test.format, test.errs, errs)
+		}
+		if tags.String() != test.tags {
+			t.Errorf("%q %q: expected tags %q, got %q", test.query, test.format, test.tags, tags.String())
+		}
+	}
+}
+
+func TestGraphiteTargetQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01.scale(cpu,2)", "datapoints": [[1, 900]]}
+	]`)}
+	e := graphiteTestState(c)
+	a, err := GraphiteTargetQuery(e, "*", "5m", "", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := opentsdb.TagSet{"host": "web01", TargetTag: "web01.scale_cpu_2_"}
+	if g := a.Results[0].Group; !g.Equal(expected) {
+		t.Errorf("expected tags %v, got %v", expected, g)
+	}
+	// the target tag doesn't keep results from joining
+	b := &Results{Results: []*Result{{Value: Series{}, Group: opentsdb.TagSet{"host": "web01"}}}}
+	if us := e.union(a, b, ""); len(us) != 1 || !us[0].Group.Equal(expected) {
+		t.Errorf("expected results to join on %v, got %v", expected, us)
+	}
+}
+
+func TestGraphitePercentileQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 900], [10, 960]]},
+		{"target": "web02", "datapoints": [[2, 900], [null, 960]]},
+		{"target": "web03", "datapoints": [[3, 900], [30, 960], [5, 1020]]}
+	]`)}
+	r, err := GraphitePercentileQuery(graphiteTestState(c), "*", "5m", "", .5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Results) != 1 || len(r.Results[0].Group) != 0 {
+		t.Fatalf("expected a single result without tags, got %v", r.Results)
+	}
+	expected := Series{time.Unix(900, 0): 2, time.Unix(960, 0): 30, time.Unix(1020, 0): 5}
+	if s := r.Results[0].Value.(Series); !reflect.DeepEqual(s, expected) {
+		t.Errorf("expected %v, got %v", expected, s)
+	}
+}
+
+// graphiteTargetsContext answers each query with the response for its target.
+type graphiteTargetsContext map[string]graphite.Response
+
+func (c graphiteTargetsContext) Query(r *graphite.Request) (graphite.Response, error) {
+	return c[r.Targets[0]], nil
+}
+
+// graphiteBatchContext answers every target of a query with the series of
+// its response in the map, and records the queries.
+type graphiteBatchContext struct {
+	sync.Mutex
+	resp map[string]graphite.Response
+	reqs []*graphite.Request
+}
+
+func (c *graphiteBatchContext) Query(r *graphite.Request) (graphite.Response, error) {
+	c.Lock()
+	defer c.Unlock()
+	c.reqs = append(c.reqs, r)
+	var resp graphite.Response
+	for _, t := range r.Targets {
+		resp = append(resp, c.resp[t]...)
+	}
+	return resp, nil
+}
+
+func TestGraphiteBatch(t *testing.T) {
+	c := &graphiteBatchContext{resp: map[string]graphite.Response{
+		"app.web01.hits": graphiteTestResponse(t, `[{"target": "app.web01.hits", "datapoints": [[1, 900]]}]`),
+		"app.web*.hits": graphiteTestResponse(t, `[
+			{"target": "app.web01.hits", "datapoints": [[1, 900]]},
+			{"target": "app.web02.hits", "datapoints": [[2, 900]]}
+		]`),
+		"sumSeries(app.*.hits)": graphiteTestResponse(t, `[{"target": "total", "datapoints": [[3, 900]]}]`),
+	}}
+	queries := map[string]int{"app.web01.hits": 1, "app.web*.hits": 2, "sumSeries(app.*.hits)": 1}
+	var wg sync.WaitGroup
+	for query, expected := range queries {
+		wg.Add(1)
+		go func(query string, expected int) {
+			defer wg.Done()
+			e := graphiteTestState(c)
+			e.GraphiteConfig.BatchWindow = 50 * time.Millisecond
+			format := ".host."
+			if strings.HasPrefix(query, "sumSeries") {
+				format = "host"
+			}
+			r, err := GraphiteQuery(e, query, "5m", "", format)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if len(r.Results) != expected {
+				t.Errorf("%s: expected %d results, got %v", query, expected, r.Results)
+			}
+		}(query, expected)
+	}
+	wg.Wait()
+	if len(c.reqs) != 2 {
+		t.Fatalf("expected the metric paths to be sent together, got %d requests", len(c.reqs))
+	}
+	for _, r := range c.reqs {
+		if len(r.Targets) == 2 && !reflect.DeepEqual(r.Targets, []string{"app.web*.hits", "app.web01.hits"}) {
+			t.Errorf("unexpected targets %v", r.Targets)
+		}
+	}
+}
+
+func TestGraphiteBatchHeaders(t *testing.T) {
+	c := &graphiteBatchContext{resp: map[string]graphite.Response{
+		"app.web01.hits": graphiteTestResponse(t, `[{"target": "app.web01.hits", "datapoints": [[1, 900]]}]`),
+		"app.web02.hits": graphiteTestResponse(t, `[{"target": "app.web02.hits", "datapoints": [[2, 900]]}]`),
+	}}
+	var wg sync.WaitGroup
+	for _, host := range []string{"web01", "web02"} {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			e := graphiteTestState(c)
+			e.GraphiteConfig.BatchWindow = 50 * time.Millisecond
+			e.GraphiteConfig.OriginHeader = "X-Bosun-Origin"
+			e.Origin = host
+			if _, err := GraphiteQuery(e, "app."+host+".hits", "5m", "", ".host."); err != nil {
+				t.Error(err)
+			}
+		}(host)
+	}
+	wg.Wait()
+	if len(c.reqs) != 2 {
+		t.Fatalf("expected queries with different headers to be sent apart, got %d requests", len(c.reqs))
+	}
+	for _, r := range c.reqs {
+		if len(r.Targets) != 1 || r.Targets[0] != "app."+r.Header.Get("X-Bosun-Origin")+".hits" {
+			t.Errorf("expected the headers of the query of %v, got %v", r.Targets, r.Header)
+		}
+	}
+}
+
+// graphiteBatchCancelContext is a graphite.Context whose queries signal
+// started once they are sent and cancelled once they are cancelled.
+type graphiteBatchCancelContext struct {
+	graphiteBlockingContext
+	started, cancelled chan struct{}
+}
+
+func (c graphiteBatchCancelContext) QueryContext(ctx context.Context, r *graphite.Request) (graphite.Response, error) {
+	close(c.started)
+	<-ctx.Done()
+	close(c.cancelled)
+	return nil, ctx.Err()
+}
+
+func TestGraphiteBatchCancel(t *testing.T) {
+	c := graphiteBatchCancelContext{started: make(chan struct{}), cancelled: make(chan struct{})}
+	var cancels []context.CancelFunc
+	done := make(chan error)
+	for _, host := range []string{"web01", "web02"} {
+		e := graphiteTestState(c)
+		e.GraphiteConfig.BatchWindow = 50 * time.Millisecond
+		var cancel context.CancelFunc
+		e.ctx, cancel = context.WithCancel(context.Background())
+		cancels = append(cancels, cancel)
+		go func(e *State, host string) {
+			_, err := GraphiteQuery(e, "app."+host+".hits", "5m", "", ".host.")
+			done <- err
+		}(e, host)
+	}
+	select {
+	case <-c.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("batch was not sent")
+	}
+	// the batch is still sent for the query that is not aborted
+	cancels[0]()
+	if err := <-done; err == nil {
+		t.Error("expected error for the aborted query")
+	}
+	select {
+	case <-c.cancelled:
+		t.Fatal("expected the batch not to be cancelled with one of its queries")
+	case <-time.After(20 * time.Millisecond):
+	}
+	cancels[1]()
+	select {
+	case <-c.cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the batch to be cancelled once all its queries are aborted")
+	}
+	if err := <-done; err == nil {
+		t.Error("expected error for the aborted query")
+	}
+}
+
+func TestGraphiteGlobRE(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"app.web01.hits", "app.web01.hits", true},
+		{"app.web01.hits", "app.web01Xhits", false},
+		{"app.*.hits", "app.web01.hits", true},
+		{"app.*.hits", "app.web.01.hits", false},
+		{"app.web0?.hits", "app.web01.hits", true},
+		{"app.web[0-1]1.hits", "app.web11.hits", true},
+		{"app.web[0-1]1.hits", "app.web21.hits", false},
+		{"app.{web,api}01.hits", "app.api01.hits", true},
+		{"app.{web,api}01.hits", "app.db01.hits", false},
+		{"app.web01.hits", "xapp.web01.hits", false},
+		{"app.{web{01,02},api}.hits", "app.web02.hits", true},
+		{"app.{web{01,02},api}.hits", "app.api.hits", true},
+		{"app.{web{01,02},api}.hits", "app.web03.hits", false},
+	}
+	for _, test := range tests {
+		if got := graphiteGlobRE(test.pattern).MatchString(test.name); got != test.match {
+			t.Errorf("%s matching %s: expected %v, got %v", test.pattern, test.name, test.match, got)
+		}
+	}
+	for _, pattern := range []string{"sumSeries(app.*.hits)", "app.web[01.hits"} {
+		if re := graphiteGlobRE(pattern); re != nil {
+			t.Errorf("%s: expected no regexp, got %v", pattern, re)
+		}
+	}
+}
+
+func TestGraphiteRatioQuery(t *testing.T) {
+	c := graphiteTargetsContext{
+		"errors": graphiteTestResponse(t, `[
+			{"target": "web01", "datapoints": [[1, 900], [2, 960], [3, 1020]]},
+			{"target": "web02", "datapoints": [[1, 900]]}
+		]`),
+		"requests": graphiteTestResponse(t, `[
+			{"target": "web01", "datapoints": [[4, 900], [0, 960]]}
+		]`),
+	}
+	for skip, expected := range map[bool]Series{
+		false: {time.Unix(900, 0): .25, time.Unix(960, 0): math.NaN()},
+		true:  {time.Unix(900, 0): .25},
+	} {
+		f := GraphiteRatioQuery
+		if skip {
+			f = GraphiteRatioSkipQuery
+		}
+		r, err := f(graphiteTestState(c), "errors", "requests", "5m", "", "host")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Results) != 1 || r.Results[0].Group["host"] != "web01" {
+			t.Fatalf("skip %v: expected a result for web01, got %v", skip, r.Results)
+		}
+		s := r.Results[0].Value.(Series)
+		if len(s) != len(expected) {
+			t.Errorf("skip %v: expected %v, got %v", skip, expected, s)
+		}
+		for k, v := range expected {
+			if got, ok := s[k]; !ok || got != v && !(math.IsNaN(got) && math.IsNaN(v)) {
+				t.Errorf("skip %v: at %v expected %v, got %v", skip, k.Unix(), v, got)
+			}
+		}
+	}
+}
+
+func TestGraphiteSummarizeQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 600], [5, 660], [3, 900], [null, 960], [2, 1500]]}
+	]`)}
+	tests := map[string]Series{
+		"avg":  {time.Unix(600, 0): 3, time.Unix(900, 0): 3, time.Unix(1500, 0): 2},
+		"sum":  {time.Unix(600, 0): 6, time.Unix(900, 0): 3, time.Unix(1500, 0): 2},
+		"max":  {time.Unix(600, 0): 5, time.Unix(900, 0): 3, time.Unix(1500, 0): 2},
+		"min":  {time.Unix(600, 0): 1, time.Unix(900, 0): 3, time.Unix(1500, 0): 2},
+		"last": {time.Unix(600, 0): 5, time.Unix(900, 0): 3, time.Unix(1500, 0): 2},
+	}
+	for fn, expected := range tests {
+		r, err := GraphiteSummarizeQuery(graphiteTestState(c), "*", "1h", "", "host", "5m", fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := r.Results[0].Value.(Series); !reflect.DeepEqual(s, expected) {
+			t.Errorf("%s: expected %v, got %v", fn, expected, s)
+		}
+	}
+	if _, err := GraphiteSummarizeQuery(graphiteTestState(c), "*", "1h", "", "host", "5m", "median"); err == nil {
+		t.Error("expected error for unknown function")
+	}
+}
+
+func TestGraphiteSummarizeXFFQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 600], [null, 660], [null, 720], [3, 900], [4, 960], [null, 1200]]}
+	]`)}
+	// a third of the window at 600 has values, all of the one at 900 and none
+	// of the one at 1200
+	for xff, expected := range map[float64][]float64{0.3: {1, 3.5}, 0.5: {math.NaN(), 3.5}} {
+		r, err := GraphiteSummarizeXFFQuery(graphiteTestState(c), "*", "1h", "", "host", "5m", "avg", xff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := r.Results[0].Value.(Series)
+		if len(s) != 3 || !math.IsNaN(s[time.Unix(1200, 0)]) {
+			t.Errorf("%v: expected a NaN window at 1200, got %v", xff, s)
+		}
+		for i, ts := range []int64{600, 900} {
+			if v := s[time.Unix(ts, 0)]; v != expected[i] && !(math.IsNaN(v) && math.IsNaN(expected[i])) {
+				t.Errorf("%v: expected %v at %d, got %v", xff, expected[i], ts, v)
+			}
+		}
+	}
+	if _, err := GraphiteSummarizeXFFQuery(graphiteTestState(c), "*", "1h", "", "host", "5m", "avg", 2); err == nil {
+		t.Error("expected error for xFilesFactor above 1")
+	}
+}
+
+func TestGraphiteTemplateQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 900]]}
+	]`)}
+	e := graphiteTestState(c)
+	if _, err := GraphiteTemplateQuery(e, "template($dc.$host.cpu)", "5m", "", "host", "dc=ny, host = web*"); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]string{"dc": "ny", "host": "web*"}
+	if got := c.reqs[0].Template; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected template %v, got %v", expected, got)
+	}
+	for _, vars := range []string{"dc", "=ny", "dc=ny,dc=la"} {
+		if _, err := GraphiteTemplateQuery(e, "template($dc.cpu)", "5m", "", "host", vars); err == nil {
+			t.Errorf("%q: expected error", vars)
+		}
+	}
+}
+
+func TestGraphiteConfigTemplates(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 900]]}
+	]`)}
+	e := graphiteTestState(c)
+	e.GraphiteConfig.Templates = map[string]string{
+		"cpu":   "sumSeries($dc.$host.cpu.*)",
+		"hosts": "web*",
+	}
+	if _, err := GraphiteQuery(e, "aliasByNode(@cpu(dc=ny, host=web01), 1)", "5m", "", "host"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GraphiteMultiQuery(e, "@hosts, @cpu(dc=la,host=web*)", "5m", "", "host|host"); err != nil {
+		t.Fatal(err)
+	}
+	// the values of variables are not expanded again
+	if _, err := GraphiteMultiQuery(e, "@cpu(dc=ny,host=@hosts)", "5m", "", "host"); err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{
+		{"aliasByNode(sumSeries(ny.web01.cpu.*), 1)"},
+		{"web*", "sumSeries(la.web*.cpu.*)"},
+		{"sumSeries(ny.@hosts.cpu.*)"},
+	}
+	if len(c.reqs) != len(expected) {
+		t.Fatalf("expected %d requests, got %d", len(expected), len(c.reqs))
+	}
+	for i, req := range c.reqs {
+		if !reflect.DeepEqual(req.Targets, expected[i]) {
+			t.Errorf("expected targets %q, got %q", expected[i], req.Targets)
+		}
+	}
+	// the series are matched with the expanded targets for their format
+	c.resp = graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 900]]},
+		{"target": "servers.db01.cpu", "datapoints": [[2, 900]]}
+	]`)
+	e.GraphiteConfig.Templates["servers"] = "servers.db01.cpu"
+	r, err := GraphiteMultiQuery(e, "@hosts|@servers", "5m", "", "host|.host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, res := range r.Results {
+		if h := res.Group["host"]; h != "web01" && h != "db01" {
+			t.Errorf("expected the format of each template, got %v", res.Group)
+		}
+	}
+	if r, err := GraphiteExists(e, "@servers"); err != nil || r.Results[0].Value != Scalar(1) {
+		t.Errorf("expected graphiteExists to expand templates, got %v, %v", r, err)
+	}
+	for _, query := range []string{"@mem", "@cpu(dc=ny)", "@cpu(dc=ny,host=web01,env=prod)", "@hosts(dc=ny)"} {
+		if _, err := GraphiteQuery(e, query, "5m", "", "host"); err == nil {
+			t.Errorf("%q: expected error", query)
+		}
+	}
+	for _, templates := range []map[string]string{{"a.b": "x"}, {"a": " "}, {"a": "@b"}} {
+		if err := CheckGraphiteTemplates(templates); err == nil {
+			t.Errorf("%v: expected error", templates)
+		}
+	}
+}
+
+func TestGraphiteTimeRange(t *testing.T) {
+	c := &graphiteTestContext{}
+	e := graphiteTestState(c)
+	if _, err := GraphiteQuery(e, "*", "5m", "10m", "host"); err == nil {
+		t.Error("expected error for start after end")
+	}
+	if _, err := GraphiteBand(e, "*", "0s", "1h", "host", 1); err == nil {
+		t.Error("expected error for empty band window")
+	}
+	if len(c.reqs) != 0 {
+		t.Errorf("expected no requests to graphite, got %d", len(c.reqs))
+	}
+}
+
+func TestGraphiteBandNumBounds(t *testing.T) {
+	for _, num := range []float64{0, 101} {
+		c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+			{"target": "web01", "datapoints": [[1, 900]]}
+		]`)}
+		_, err := GraphiteBand(graphiteTestState(c), "*", "1h", "1d", "host", num)
+		if err == nil || !strings.Contains(err.Error(), "num out of bounds") {
+			t.Errorf("num %v: expected out of bounds error, got %v", num, err)
+		}
+		if len(c.reqs) != 0 {
+			t.Errorf("num %v: expected no requests to graphite, got %d", num, len(c.reqs))
+		}
+	}
+}
+
+func TestGraphiteLastQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 900], [2, 960], [null, 1020]]},
+		{"target": "web02", "datapoints": [[null, 900], [null, 960]]},
+		{"target": "web03", "datapoints": [[3, 900]]}
+	]`)}
+	r, err := GraphiteLastQuery(graphiteTestState(c), "*", "5m", "", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]Number{"web01": 2, "web03": 3}
+	if len(r.Results) != len(expected) {
+		t.Fatalf("expected %d results, got %v", len(expected), r.Results)
+	}
+	for _, res := range r.Results {
+		if v := res.Value.(Number); v != expected[res.Group["host"]] {
+			t.Errorf("%v: expected %v, got %v", res.Group, expected[res.Group["host"]], v)
+		}
+	}
+}
+
+func TestGraphiteIntegralQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 900], [3, 960], [null, 1020], [5, 1080], [7, 1140]]},
+		{"target": "web02", "datapoints": [[null, 900], [null, 960]]}
+	]`)}
+	for gaps, expected := range map[string]Number{"interpolate": 960, "break": 480} {
+		r, err := GraphiteIntegralQuery(graphiteTestState(c), "*", "5m", "", "host", gaps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Results) != 1 {
+			t.Fatalf("%s: expected 1 result, got %v", gaps, r.Results)
+		}
+		if v := r.Results[0].Value.(Number); v != expected {
+			t.Errorf("%s: expected %v, got %v", gaps, expected, v)
+		}
+	}
+	if _, err := GraphiteIntegralQuery(graphiteTestState(c), "*", "5m", "", "host", "zero"); err == nil {
+		t.Error("expected error for unknown gaps")
+	}
+}
+
+func TestGraphiteExists(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01.cpu", "datapoints": []}
+	]`)}
+	for query, expected := range map[string]Scalar{"web01.cpu": 1, "web02.cpu": 0} {
+		r, err := GraphiteExists(graphiteTestState(c), query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := r.Results[0].Value; v != expected {
+			t.Errorf("%q: expected %v, got %v", query, expected, v)
+		}
+	}
+	if len(c.reqs) != 0 {
+		t.Errorf("expected no render requests, got %d", len(c.reqs))
+	}
+}
+
+// graphiteFailingFindContext fails the first fails find requests.
+type graphiteFailingFindContext struct {
+	graphiteTestContext
+	fails int
+	finds int
+}
+
+func (c *graphiteFailingFindContext) Find(ctx context.Context, r *graphite.FindRequest) ([]graphite.Metric, error) {
+	if c.finds++; c.finds <= c.fails {
+		return nil, &graphite.RequestError{StatusCode: http.StatusServiceUnavailable, Msg: "graphite unavailable"}
+	}
+	return c.graphiteTestContext.Find(ctx, r)
+}
+
+func TestGraphiteExistsRetries(t *testing.T) {
+	c := &graphiteFailingFindContext{fails: 1}
+	e := graphiteTestState(c)
+	e.GraphiteConfig.Retries = 1
+	if _, err := GraphiteExists(e, "web01.cpu"); err != nil {
+		t.Fatal(err)
+	}
+	if c.finds != 2 {
+		t.Errorf("expected the find request to be retried, got %d requests", c.finds)
+	}
+}
+
+func TestGraphiteNoCacheQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[{"target": "web01", "datapoints": [[1, 900]]}]`)}
+	e := graphiteTestState(c)
+	e.Cache = cache.New("test", 10)
+	for _, f := range []func(e *State, query, sduration, eduration, format string) (*Results, error){
+		GraphiteQuery, GraphiteNoCacheQuery, GraphiteNoCacheQuery, GraphiteQuery,
+	} {
+		if _, err := f(e, "*", "5m", "", "host"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(c.reqs) != 3 {
+		t.Errorf("expected 3 requests to graphite, got %d", len(c.reqs))
+	}
+	if len(e.graphiteQueries) != 4 {
+		t.Errorf("expected 4 recorded queries, got %d", len(e.graphiteQueries))
+	}
+}
+
+func TestGraphiteCacheFormats(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01.cpu", "tags": {"name": "cpu"}, "datapoints": [[1, 900]]}
+	]`)}
+	e := graphiteTestState(c)
+	e.Cache = cache.New("test", 10)
+	tests := []struct {
+		f    func(e *State, query, sduration, eduration, format string) (*Results, error)
+		tags opentsdb.TagSet
+	}{
+		{GraphiteQuery, opentsdb.TagSet{"host": "web01", "metric": "cpu"}},
+		{GraphiteTargetQuery, opentsdb.TagSet{"host": "web01", "metric": "cpu", TargetTag: "web01.cpu"}},
+		{GraphiteTaggedQuery, opentsdb.TagSet{"name": "cpu"}},
+		{GraphiteQuery, opentsdb.TagSet{"host": "web01", "metric": "cpu"}},
+	}
+	for i, test := range tests {
+		r, err := test.f(e, "*", "5m", "", "host.metric")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g := r.Results[0].Group; !g.Equal(test.tags) {
+			t.Errorf("query %d: expected %v, got %v", i, test.tags, g)
+		}
+	}
+	if len(c.reqs) != 1 {
+		t.Errorf("expected 1 request to graphite, got %d", len(c.reqs))
+	}
+}
+
+func TestGraphiteDefaultEndOffset(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 900]]}
+	]`)}
+	e := graphiteTestState(c)
+	e.GraphiteConfig.DefaultEndOffset = time.Minute
+	for _, test := range []struct {
+		eduration string
+		end       int64
+	}{
+		{"", 940},
+		{"0s", 1000},
+		{"2m", 880},
+	} {
+		if _, err := GraphiteQuery(e, "*", "5m", test.eduration, "host"); err != nil {
+			t.Fatal(err)
+		}
+		if end := c.reqs[len(c.reqs)-1].End.Unix(); end != test.end {
+			t.Errorf("eduration %q: expected end %d, got %d", test.eduration, test.end, end)
+		}
+	}
+}
+
+func TestGraphiteFromUntilQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 900]]}
+	]`)}
+	if _, err := GraphiteFromUntilQuery(graphiteTestState(c), "*", "-1d", "midnight", "host"); err != nil {
+		t.Fatal(err)
+	}
+	req := c.reqs[0]
+	if req.Start != nil || req.End != nil || req.From != "-1d" || req.Until != "midnight" {
+		t.Errorf("unexpected request time range %+v", req)
+	}
+	other := *req
+	other.Until = ""
+	if req.CacheKey() == other.CacheKey() {
+		t.Errorf("until is not part of the cache key")
+	}
+}
+
+func TestGraphiteMergeQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01.a", "datapoints": [[1, 900], [2, 960]]},
+		{"target": "web01.b", "datapoints": [[3, 960], [4, 1020]]}
+	]`)}
+	e := graphiteTestState(c)
+	if _, err := GraphiteQuery(e, "*.*", "5m", "", "host"); err == nil {
+		t.Error("expected tagset collision error")
+	}
+	r, err := GraphiteMergeQuery(e, "*.*", "5m", "", "host", "sum")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Series{time.Unix(900, 0): 1, time.Unix(960, 0): 5, time.Unix(1020, 0): 4}
+	if len(r.Results) != 1 || !r.Results[0].Value.(Series).Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, r.Results)
+	}
+	if _, err := GraphiteMergeQuery(e, "*.*", "5m", "", "host", "avg"); err == nil {
+		t.Error("expected error for unknown merge function")
+	}
+}
+
+// graphiteFailingContext fails the first fails queries with status, or 503
+// if it is 0.
+type graphiteFailingContext struct {
+	graphiteTestContext
+	fails  int
+	status int
+}
+
+func (c *graphiteFailingContext) Query(r *graphite.Request) (graphite.Response, error) {
+	if len(c.reqs) < c.fails {
+		c.reqs = append(c.reqs, r)
+		status := c.status
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		return nil, &graphite.RequestError{StatusCode: status, Msg: "graphite unavailable"}
+	}
+	return c.graphiteTestContext.Query(r)
+}
+
+func TestGraphiteFailover(t *testing.T) {
+	primary := &graphiteFailingContext{fails: 2}
+	secondary := &graphiteTestContext{resp: graphiteTestResponse(t, `[{"target": "web01", "datapoints": [[1, 900]]}]`)}
+	e := graphiteTestState(primary)
+	e.GraphiteFailover = []graphite.Context{secondary}
+	if _, err := GraphiteQuery(e, "*", "5m", "", "host"); err != nil {
+		t.Fatal(err)
+	}
+	if len(primary.reqs) != 1 || len(secondary.reqs) != 1 {
+		t.Errorf("expected one query of each cluster, got %d and %d", len(primary.reqs), len(secondary.reqs))
+	}
+	if _, err := GraphitePrimaryQuery(graphiteTestState(primary), "*", "5m", "", "host"); err == nil {
+		t.Error("expected graphitePrimary not to fail over")
+	}
+	if len(secondary.reqs) != 1 {
+		t.Errorf("expected graphitePrimary not to query the failover cluster")
+	}
+	// an empty answer of the failover cluster isn't missing data
+	e = graphiteTestState(&graphiteFailingContext{fails: 1})
+	e.GraphiteFailover = []graphite.Context{&graphiteTestContext{resp: graphite.Response{}}}
+	if _, err := GraphiteQuery(e, "*", "5m", "", "host"); err == nil || IsNoData(err) {
+		t.Errorf("expected an error other than missing data, got %v", err)
+	}
+}
+
+func TestGraphiteFailoverSource(t *testing.T) {
+	primary := &graphiteFailingContext{fails: 1}
+	secondary := &graphiteTestContext{resp: graphiteTestResponse(t, `[{"target": "web01", "datapoints": [[1, 900]]}]`)}
+	e := graphiteTestState(primary)
+	e.Cache = cache.New("test", 10)
+	e.GraphiteFailover = []graphite.Context{secondary}
+	e.GraphiteConfig.SourceTag = "cluster"
+	e.GraphiteConfig.Source = "ny"
+	e.GraphiteConfig.FailoverSources = []string{"sf"}
+	// the second query is answered from the cache
+	for i := 0; i < 2; i++ {
+		r, err := GraphiteQuery(e, "*", "5m", "", "host")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Results) != 1 || r.Results[0].Group["cluster"] != "sf" {
+			t.Errorf("expected results of the failover cluster, got %v", r.Results)
+		}
+	}
+	if len(secondary.reqs) != 1 {
+		t.Errorf("expected one query of the failover cluster, got %d", len(secondary.reqs))
+	}
+}
+
+func TestGraphiteRetries(t *testing.T) {
+	c := &graphiteFailingContext{fails: 2}
+	c.resp = graphiteTestResponse(t, `[{"target": "web01", "datapoints": [[1, 900]]}]`)
+	e := graphiteTestState(c)
+	e.GraphiteConfig.Retries = 1
+	if _, err := GraphiteQuery(e, "*", "5m", "", "host"); err == nil {
+		t.Error("expected error after exhausting retries")
+	}
+	c.reqs = nil
+	e.GraphiteConfig.Retries = 2
+	if _, err := GraphiteQuery(e, "*", "5m", "", "host"); err != nil {
+		t.Error(err)
+	}
+	if len(c.reqs) != 3 {
+		t.Errorf("expected 3 requests, got %d", len(c.reqs))
+	}
+	c.reqs = nil
+	e.GraphiteConfig.RetryBackoff = time.Hour
+	e.GraphiteConfig.RetryDeadline = time.Minute
+	if _, err := GraphiteQuery(e, "*", "5m", "", "host"); err == nil {
+		t.Error("expected retry to be stopped by the deadline")
+	}
+	// graphite rejecting the query isn't retried
+	bad := &graphiteFailingContext{fails: 100, status: http.StatusNotFound}
+	e = graphiteTestState(bad)
+	e.GraphiteConfig.Retries = 2
+	if _, err := GraphiteQuery(e, "*", "5m", "", "host"); err == nil {
+		t.Error("expected error for a rejected query")
+	}
+	if len(bad.reqs) != 1 {
+		t.Errorf("expected a rejected query not to be retried, got %d requests", len(bad.reqs))
+	}
+	// the deadline also cancels an attempt that is still running
+	e = graphiteTestState(graphiteSlowContext{})
+	e.GraphiteConfig.RetryDeadline = 10 * time.Millisecond
+	start := time.Now()
+	_, err := GraphiteQuery(e, "*", "5m", "", "host")
+	if _, ok := err.(*graphiteTimeoutError); !ok {
+		t.Errorf("expected a timeout at the retry deadline, got %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("expected the attempt to be cancelled at the retry deadline, took %v", d)
+	}
+}
+
+// graphitePartialContext streams the first series of its response and then
+// fails the first fails queries.
+type graphitePartialContext struct {
+	graphiteTestContext
+	fails int
+}
+
+func (c *graphitePartialContext) QueryStream(ctx context.Context, r *graphite.Request, fn func(graphite.Series) error) error {
+	c.reqs = append(c.reqs, r)
+	for i, s := range c.resp {
+		if i == 1 && len(c.reqs) <= c.fails {
+			return &graphite.RequestError{StatusCode: http.StatusServiceUnavailable, Msg: "graphite unavailable"}
+		}
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestGraphiteStreamRetries(t *testing.T) {
+	c := &graphitePartialContext{fails: 1}
+	c.resp = graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 900]]},
+		{"target": "web02", "datapoints": [[2, 900]]}
+	]`)
+	e := graphiteTestState(c)
+	e.GraphiteConfig.Retries = 2
+	// the series of the failed attempt are parsed again, not as duplicates
+	r, err := GraphiteQuery(e, "*", "5m", "", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Results) != 2 || len(c.reqs) != 2 {
+		t.Errorf("expected 2 results from 2 requests, got %d from %d", len(r.Results), len(c.reqs))
+	}
+	if s := e.GraphiteResponses(); len(s) != 1 || len(s[0].Series) != 2 {
+		t.Errorf("expected a summary of the 2 series, got %v", s)
+	}
+	// parse errors aren't retried
+	c.reqs, c.fails = nil, 0
+	c.resp[1].Target = "web01"
+	if _, err := GraphiteQuery(e, "*", "5m", "", "host"); err == nil {
+		t.Error("expected duplicate tagsets to fail")
+	}
+	if len(c.reqs) != 1 {
+		t.Errorf("expected parse errors not to be retried, got %d requests", len(c.reqs))
+	}
+}
+
+// graphiteStreamCheckContext streams its response and records for each
+// series how many series had been added to the stream once it was sent.
+type graphiteStreamCheckContext struct {
+	graphiteTestContext
+	added *int
+	seen  []int
+}
+
+func (c *graphiteStreamCheckContext) QueryStream(ctx context.Context, r *graphite.Request, fn func(graphite.Series) error) error {
+	c.reqs = append(c.reqs, r)
+	for _, s := range c.resp {
+		if err := fn(s); err != nil {
+			return err
+		}
+		c.seen = append(c.seen, *c.added)
+	}
+	return nil
+}
+
+func TestGraphiteStreamCached(t *testing.T) {
+	added := 0
+	c := &graphiteStreamCheckContext{added: &added}
+	c.resp = graphiteTestResponse(t, `[
+		{"target": "web01.cpu", "datapoints": [[1, 900]]},
+		{"target": "web01.mem", "datapoints": [[2, 900]]}
+	]`)
+	e := graphiteTestState(c)
+	e.Cache = cache.New("test", 10)
+	stream := &graphiteStream{
+		start: func(int) { added = 0 },
+		add: func(*graphite.Series) error {
+			added++
+			return nil
+		},
+	}
+	resp, _, err := timeGraphiteRequestCached(e, &graphite.Request{Targets: []string{"web01.*"}}, true, true, stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c.seen, []int{1, 2}) {
+		t.Errorf("expected the series to be streamed as they are decoded, got %v", c.seen)
+	}
+	if len(resp) != 2 {
+		t.Errorf("expected the whole response to be kept for the cache, got %v", resp)
+	}
+	// a format that fails on the streamed series doesn't fail the cached
+	// response for other formats
+	c.reqs = nil
+	if _, err := GraphiteQuery(e, "web01.*", "5m", "", "host."); err == nil {
+		t.Error("expected duplicate tagsets to fail")
+	}
+	r, err := GraphiteQuery(e, "web01.*", "5m", "", "host.metric")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Results) != 2 || len(c.reqs) != 1 {
+		t.Errorf("expected 2 results from 1 request, got %d from %d", len(r.Results), len(c.reqs))
+	}
+}
+
+// graphiteSlowContext blocks queries until they are cancelled.
+type graphiteSlowContext struct{}
+
+func (graphiteSlowContext) Query(r *graphite.Request) (graphite.Response, error) {
+	return graphiteSlowContext{}.QueryContext(context.Background(), r)
+}
+
+func (graphiteSlowContext) QueryContext(ctx context.Context, r *graphite.Request) (graphite.Response, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestGraphiteTimeout(t *testing.T) {
+	e := graphiteTestState(graphiteSlowContext{})
+	e.GraphiteConfig.Timeout = 10 * time.Millisecond
+	_, err := GraphiteQuery(e, "*", "5m", "", "host")
+	if err == nil || !strings.Contains(err.Error(), "timed out after 10ms") {
+		t.Errorf("expected timeout error, got %v", err)
+	}
+	if e.graphiteQueries[0].Timeout != e.GraphiteConfig.Timeout {
+		t.Errorf("timeout is not recorded in the graphite queries")
+	}
+}
+
+func TestGraphiteQueryName(t *testing.T) {
+	tests := map[string]string{
+		"collectd.web01.cpu":                       "collectd",
+		"sumSeries(collectd.*.cpu)":                "collectd",
+		"asPercent(app-1.hits, sumSeries(x.hits))": "app-1",
+		"web01":                   "web01",
+		"seriesByTag('name=cpu')": "seriesByTag_name_cpu_",
+	}
+	for target, name := range tests {
+		if got := graphiteQueryName([]string{target}); got != name {
+			t.Errorf("%q: expected %q, got %q", target, name, got)
+		}
+	}
+}
+
+func TestGraphiteLimiter(t *testing.T) {
+	var l graphiteLimiter
+	now := time.Unix(1000, 0)
+	// 2 queries per second with a burst of 3
+	expected := []time.Duration{0, 0, 0, 500 * time.Millisecond, time.Second}
+	for i, want := range expected {
+		if got := l.reserve(now, 2, 3); got != want {
+			t.Errorf("query %d: expected wait %v, got %v", i, want, got)
+		}
+	}
+	// after a while the bucket is full again
+	now = now.Add(time.Minute)
+	for i := 0; i < 3; i++ {
+		if got := l.reserve(now, 2, 3); got != 0 {
+			t.Errorf("query %d after refill: expected no wait, got %v", i, got)
+		}
+	}
+}
+
+func TestGraphiteBandConsolidate(t *testing.T) {
+	// every window gets the same response, so all timestamps collide
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 600], [3, 660]]}
+	]`)}
+	tests := map[string]Series{
+		"":    {time.Unix(600, 0): 1, time.Unix(660, 0): 3},
+		"avg": {time.Unix(600, 0): 1, time.Unix(660, 0): 3},
+		"sum": {time.Unix(600, 0): 3, time.Unix(660, 0): 9},
+		"max": {time.Unix(600, 0): 1, time.Unix(660, 0): 3},
+	}
+	for by, expected := range tests {
+		var r *Results
+		var err error
+		if by == "" {
+			r, err = GraphiteBand(graphiteTestState(c), "*", "10m", "1m", "host", 3)
+		} else {
+			r, err = GraphiteBandConsolidate(graphiteTestState(c), "*", "10m", "1m", "host", 3, 0, by)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Results) != 1 || !r.Results[0].Value.(Series).Equal(expected) {
+			t.Errorf("%q: expected %v, got %v", by, expected, r.Results[0].Value)
+		}
+	}
+	if _, err := GraphiteBandConsolidate(graphiteTestState(c), "*", "10m", "1m", "host", 3, 0, "median"); err == nil {
+		t.Error("expected error for unknown consolidation function")
+	}
+}
+
+func TestGraphiteCount(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01.cpu", "datapoints": [[1, 900]]},
+		{"target": "web01.mem", "datapoints": [[1, 900]]},
+		{"target": "web02.cpu", "datapoints": [[1, 900]]}
+	]`)}
+	tests := map[string]Scalar{"host": 2, "host.metric": 3}
+	for format, expected := range tests {
+		r, err := GraphiteCount(graphiteTestState(c), "*.*", "5m", "", format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.Results[0].Value; got != expected {
+			t.Errorf("%q: expected %v, got %v", format, expected, got)
+		}
+	}
+	c.resp = nil
+	r, err := GraphiteCount(graphiteTestState(c), "*.*", "5m", "", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.Results[0].Value; got != Scalar(0) {
+		t.Errorf("expected 0 for an empty response, got %v", got)
+	}
+}
+
+func TestSplitGraphiteNodes(t *testing.T) {
+	tests := map[string][]string{
+		"a.b.c":                  {"a", "b", "c"},
+		`host\.example\.com.cpu`: {"host.example.com", "cpu"},
+		`a\b.c`:                  {`a\b`, "c"},
+		`a..b\.`:                 {"a", "", "b."},
+	}
+	for in, expected := range tests {
+		if got := splitGraphiteNodes(in); !reflect.DeepEqual(got, expected) {
+			t.Errorf("%q: expected %q, got %q", in, expected, got)
+		}
+	}
+	f, err := parseGraphiteFormat("host.metric")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags, err := f.tags(`web01\.example\.com.cpu`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (opentsdb.TagSet{"host": "web01.example.com", "metric": "cpu"}); !tags.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, tags)
+	}
+}
+
+func TestGraphiteKeyedQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 900]]}
+	]`)}
+	r, err := GraphiteKeyedQuery(graphiteTestState(c), "*", "5m", "", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := (opentsdb.TagSet{"host": "web01"}); !r.Results[0].Group.Equal(expected) {
+		t.Errorf("expected %v, got %v", expected, r.Results[0].Group)
+	}
+	if _, err := GraphiteKeyedQuery(graphiteTestState(c), "*", "5m", "", "bad key"); err == nil {
+		t.Error("expected error for an invalid tag key")
+	}
+}
+
+func TestGraphiteAbsoluteQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 150]]}
+	]`)}
+	e := graphiteTestState(c)
+	if _, err := GraphiteAbsoluteQuery(e, "*", 100, 200, "host"); err != nil {
+		t.Fatal(err)
+	}
+	req := c.reqs[0]
+	if req.Start.Unix() != 100 || req.End.Unix() != 200 {
+		t.Errorf("expected range 100-200, got %v-%v", req.Start.Unix(), req.End.Unix())
+	}
+	if _, err := GraphiteAbsoluteQuery(e, "*", 200, 100, "host"); err == nil {
+		t.Error("expected error for start after end")
+	}
+}
+
+func TestGraphiteResultOrder(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web03", "datapoints": [[1, 900]]},
+		{"target": "web01", "datapoints": [[1, 900]]},
+		{"target": "web02", "datapoints": [[1, 900]]}
+	]`)}
+	r, err := GraphiteQuery(graphiteTestState(c), "*", "5m", "", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, res := range r.Results {
+		if expected := fmt.Sprintf("web0%d", i+1); res.Group["host"] != expected {
+			t.Errorf("result %d: expected host %s, got %s", i, expected, res.Group["host"])
+		}
+	}
+}
+
+func TestGraphiteTargetPaths(t *testing.T) {
+	for target, expected := range map[string][]string{
+		"a.b.c":                                          {"a.b.c"},
+		"sumSeries(app.{web,api}*.hits, a.b)":            {"app.{web,api}*.hits", "a.b"},
+		"scale(asPercent(a.*, b.*), 0.5)":                {"a.*", "b.*"},
+		"aliasByNode(a.[ab].c, 1)":                       {"a.[ab].c"},
+		"alias(a.b, \"x.y\")":                            {"a.b"},
+		"removeBelowValue(keepLastValue(a.b,true), 1e3)": {"a.b"},
+	} {
+		if got := graphiteTargetPaths(target); !reflect.DeepEqual(got, expected) {
+			t.Errorf("%s: expected %q, got %q", target, expected, got)
+		}
+	}
+}
+
+func TestEstimateGraphiteQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": []},
+		{"target": "web02", "datapoints": []}
+	]`)}
+	end := time.Unix(3600, 0)
+	est, err := EstimateGraphiteQuery(context.Background(), c, "sumSeries(web01, web02, web03)", end.Add(-time.Hour), end, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if est.Series != 2 || est.Datapoints != 120 {
+		t.Errorf("expected 2 series and 120 datapoints, got %d and %d", est.Series, est.Datapoints)
+	}
+	if len(c.reqs) != 0 {
+		t.Errorf("expected no datapoints to be queried")
+	}
+}
+
+func TestGraphiteScientificNotation(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1.23e-9, 900], [4.5E+300, 960], ["6e-7", 1020], [1e400, 1.08e3], [-1e400, 1140.0], [5e-324, 1200]]}
+	]`)}
+	r, err := GraphiteQuery(graphiteTestState(c), "*", "5m", "", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := Series{
+		time.Unix(900, 0):  1.23e-9,
+		time.Unix(960, 0):  4.5e300,
+		time.Unix(1020, 0): 6e-7,
+		time.Unix(1080, 0): math.Inf(1),
+		time.Unix(1140, 0): math.Inf(-1),
+		time.Unix(1200, 0): 5e-324,
+	}
+	if s := r.Results[0].Value.(Series); !reflect.DeepEqual(s, expected) {
+		t.Errorf("expected %v, got %v", expected, s)
+	}
+	c.resp = graphiteTestResponse(t, `[{"target": "web01", "datapoints": [[1, 900.5]]}]`)
+	if _, err := GraphiteQuery(graphiteTestState(c), "*", "5m", "", "host"); err == nil || !strings.Contains(err.Error(), "not a whole number") {
+		t.Errorf("expected error for a fractional timestamp, got %v", err)
+	}
+}
+
+func TestGraphiteCircuitBreaker(t *testing.T) {
+	b := new(graphiteCircuitBreaker)
+	now := time.Unix(1000, 0)
+	for i := 0; i < 3; i++ {
+		if err := b.allow(now, 3); err != nil {
+			t.Fatalf("query %d: unexpected error %v", i, err)
+		}
+		b.record(now, true, 3, time.Minute)
+	}
+	if _, ok := b.allow(now.Add(30*time.Second), 3).(*graphiteCircuitOpenError); !ok {
+		t.Fatal("expected the breaker to be open during the cooldown")
+	}
+	// after the cooldown a single probe is let through
+	if err := b.allow(now.Add(time.Minute), 3); err != nil {
+		t.Fatalf("expected a probe after the cooldown, got %v", err)
+	}
+	if b.allow(now.Add(time.Minute), 3) == nil {
+		t.Fatal("expected only one probe at a time")
+	}
+	b.record(now.Add(time.Minute), true, 3, time.Minute)
+	if b.allow(now.Add(90*time.Second), 3) == nil {
+		t.Fatal("expected a failed probe to open the breaker again")
+	}
+	if err := b.allow(now.Add(2*time.Minute), 3); err != nil {
+		t.Fatal(err)
+	}
+	b.record(now.Add(2*time.Minute), false, 3, time.Minute)
+	if err := b.allow(now.Add(2*time.Minute), 3); err != nil {
+		t.Errorf("expected a successful probe to close the breaker, got %v", err)
+	}
+}
+
+func TestGraphiteCircuitBreakerQuery(t *testing.T) {
+	// queries are rejected by graphite, which doesn't open the breaker
+	c := &graphiteFailingContext{fails: 100, status: http.StatusBadRequest}
+	e := graphiteTestState(c)
+	e.GraphiteConfig.State = NewGraphiteState()
+	e.GraphiteConfig.CircuitBreakerFailures = 2
+	e.GraphiteConfig.CircuitBreakerCooldown = time.Hour
+	for i := 0; i < 3; i++ {
+		_, err := GraphiteNoCacheQuery(e, "*", "5m", "", "host")
+		if err == nil || strings.Contains(err.Error(), "circuit breaker open") {
+			t.Fatalf("expected graphite's error, got %v", err)
+		}
+	}
+	// retries of a query count once, and rejected queries in between
+	// neither count nor reset the failures
+	c.reqs = nil
+	e.GraphiteConfig.Retries = 2
+	for _, status := range []int{http.StatusServiceUnavailable, http.StatusNotFound, http.StatusServiceUnavailable} {
+		c.status = status
+		if _, err := GraphiteNoCacheQuery(e, "*", "5m", "", "host"); err == nil {
+			t.Fatal("expected an error")
+		}
+	}
+	if len(c.reqs) != 7 {
+		t.Errorf("expected 7 queries before the breaker opened, got %d", len(c.reqs))
+	}
+	_, err := GraphiteNoCacheQuery(e, "*", "5m", "", "host")
+	if err == nil || !strings.Contains(err.Error(), "circuit breaker open") {
+		t.Errorf("expected circuit breaker error, got %v", err)
+	}
+	if len(c.reqs) != 7 {
+		t.Errorf("expected no query while the breaker is open, got %d", len(c.reqs)-7)
+	}
+	// the breaker of one graphite doesn't stop the queries of another
+	other := graphiteTestState(c)
+	other.GraphiteConfig = e.GraphiteConfig
+	other.GraphiteConfig.State = NewGraphiteState()
+	if _, err := GraphiteNoCacheQuery(other, "*", "5m", "", "host"); err == nil || strings.Contains(err.Error(), "circuit breaker open") {
+		t.Errorf("expected graphite's error, got %v", err)
+	}
+}
+
+func TestGraphiteAllowQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "app.web01.hits", "datapoints": [[1, 900]]},
+		{"target": "app.web02.hits", "datapoints": [[1, 900]]},
+		{"target": "app.5f0c3a.hits", "datapoints": [[1, 900]]}
+	]`)}
+	r, err := GraphiteAllowQuery(graphiteTestState(c), "app.*.hits", "5m", "", ".host", `host=web\d+`, "drop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Results) != 2 {
+		t.Errorf("expected 2 results, got %d", len(r.Results))
+	}
+	_, err = GraphiteAllowQuery(graphiteTestState(c), "app.*.hits", "5m", "", ".host", `host=web\d+`, "error")
+	if err == nil || !strings.Contains(err.Error(), "host=5f0c3a, which is not allowed") {
+		t.Errorf("expected error for a disallowed value, got %v", err)
+	}
+	// the regex must match the whole value
+	r, err = GraphiteAllowQuery(graphiteTestState(c), "app.*.hits", "5m", "", ".host", "host=web0", "drop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Results) != 0 {
+		t.Errorf("expected no results, got %d", len(r.Results))
+	}
+	for _, allow := range []string{"", "host", "host=(", "host=a host=b"} {
+		if _, err := parseGraphiteAllow(allow); err == nil {
+			t.Errorf("%q: expected error", allow)
+		}
+	}
+	args := []parse.Node{nil, nil, nil, &parse.StringNode{Text: ".host"}, &parse.StringNode{Text: "dc=ny"}}
+	if _, err := graphiteAllowTags(args); err == nil {
+		t.Error("expected error for a tag not in the format")
+	}
+}
+
+func TestGraphiteRawQuery(t *testing.T) {
+	body := `[{"datapoints":[[1.5,900],[null,960]],"target":"web01"},{"datapoints":[],"target":"web02","tags":{"name":"web02"}}]`
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, body)}
+	r, err := GraphiteRawQuery(graphiteTestState(c), "*", "5m", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := r.Results[0].Value.(String); string(s) != body {
+		t.Errorf("expected %s, got %s", body, s)
+	}
+	c.resp = nil
+	r, err = GraphiteRawQuery(graphiteTestState(c), "*", "5m", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := r.Results[0].Value.(String); s != "[]" {
+		t.Errorf("expected an empty list, got %s", s)
+	}
+}
+
+func TestGraphiteTimestampsAtBucketEnd(t *testing.T) {
+	// the None datapoint at 960 was left out by noNullPoints
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 900], [3, 1020], [4, 1080]]},
+		{"target": "web02", "datapoints": [[1, 900]]}
+	]`)}
+	e := graphiteTestState(c)
+	e.GraphiteConfig.TimestampsAtBucketEnd = true
+	r, err := GraphiteQuery(e, "*", "5m", "", "host")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]Series{
+		"web01": {time.Unix(960, 0): 1, time.Unix(1080, 0): 3, time.Unix(1140, 0): 4},
+		"web02": {time.Unix(900, 0): 1},
+	}
+	for _, res := range r.Results {
+		if s := res.Value.(Series); !reflect.DeepEqual(s, expected[res.Group["host"]]) {
+			t.Errorf("%s: expected %v, got %v", res.Group["host"], expected[res.Group["host"]], s)
+		}
+	}
+}
+
+func TestGraphiteArgMaxQuery(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01", "datapoints": [[1, 900], [5, 960], [null, 1020], [5, 1080], [0, 1140]]},
+		{"target": "web02", "datapoints": [[null, 900]]}
+	]`)}
+	for name, f := range map[string]func(*State, string, string, string, string) (*Results, error){
+		"max": GraphiteArgMaxQuery,
+		"min": GraphiteArgMinQuery,
+	} {
+		r, err := f(graphiteTestState(c), "*", "5m", "", "host")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Results) != 1 {
+			t.Fatalf("%s: expected only web01, got %d results", name, len(r.Results))
+		}
+		// ties resolve to the earliest timestamp
+		expected := map[string]Number{"max": 960, "min": 1140}[name]
+		if v := r.Results[0].Value.(Number); v != expected {
+			t.Errorf("%s: expected %v, got %v", name, expected, v)
+		}
+	}
+}
+
+func TestGraphiteStrictNodes(t *testing.T) {
+	c := &graphiteTestContext{resp: graphiteTestResponse(t, `[
+		{"target": "web01.cpu.percent", "datapoints": [[1, 900]]}
+	]`)}
+	for format, ok := range map[string]bool{
+		"host.metric":         false,
+		"host.metric.":        true,
+		"host.**":             true,
+		"host.metric,host.**": true,
+		"host,metric":         false,
+	} {
+		e := graphiteTestState(c)
+		if _, err := GraphiteQuery(e, "*", "5m", "", format); err != nil {
+			t.Fatalf("%s: expected the extra node to be ignored by default, got %v", format, err)
+		}
+		e.GraphiteConfig.StrictNodes = true
+		_, err := GraphiteQuery(e, "*", "5m", "", format)
+		if ok && err != nil {
+			t.Errorf("%s: unexpected error %v", format, err)
+		} else if !ok && err == nil {
+			t.Errorf("%s: expected error in strict mode", format)
+		}
+	}
+}
+
+// graphiteFlatBandContext answers windows ending at its value with 2 and all
+// other windows with 1.
+type graphiteFlatBandContext int64
+
+func (c graphiteFlatBandContext) Query(r *graphite.Request) (graphite.Response, error) {
+	v := "1"
+	if r.End.Unix() == int64(c) {
+		v = "2"
+	}
+	return graphite.Response{{Target: "web01", Datapoints: []graphite.DataPoint{
+		{json.Number(v), json.Number(fmt.Sprint(r.End.Unix()))},
+	}}}, nil
+}
+
+func TestGraphiteBandZScore(t *testing.T) {
+	e := graphiteTestState(graphiteWindowContext{})
+	e.now = time.Unix(10*3600, 0)
+	// the windows of web01 end at 9h, 8h, 7h and 6h with their end as value,
+	// and the current window at 10h
+	r, err := GraphiteBandZScore(e, "*", "30m", "1h", "host", 4, "nan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, res := range r.Results {
+		values[res.Group["host"]] = float64(res.Value.(Number))
+	}
+	expected := 2.5 / math.Sqrt(5.0/3)
+	if len(values) != 1 || math.Abs(values["web01"]-expected) > 1e-9 {
+		t.Errorf("expected only web01 with %v, got %v", expected, values)
+	}
+	// a flat band with a different current value
+	e = graphiteTestState(graphiteFlatBandContext(10 * 3600))
+	e.now = time.Unix(10*3600, 0)
+	for mode, check := range map[string]func(float64) bool{
+		"nan":  math.IsNaN,
+		"zero": func(v float64) bool { return v == 0 },
+	} {
+		r, err = GraphiteBandZScore(e, "*", "30m", "1h", "host", 4, mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(r.Results) != 1 {
+			t.Fatalf("%s: expected one result, got %v", mode, r.Results)
+		}
+		if v := float64(r.Results[0].Value.(Number)); !check(v) {
+			t.Errorf("%s: unexpected value %v", mode, v)
+		}
+	}
+	if _, err := GraphiteBandZScore(e, "*", "30m", "1h", "host", 4, "one"); err == nil {
+		t.Error("expected error for unknown zeroVariance")
+	}
+}
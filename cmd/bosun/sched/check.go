@@ -70,12 +70,14 @@ func (s *Schedule) NewRunHistory(start time.Time, cache *cache.Cache) *RunHistor
 		Events:   make(map[models.AlertKey]*models.Event),
 		schedule: s,
 		Backends: &expr.Backends{
-			TSDBContext:     s.SystemConf.GetTSDBContext(),
-			GraphiteContext: s.SystemConf.GetGraphiteContext(),
-			InfluxConfig:    s.SystemConf.GetInfluxContext(),
-			ElasticHosts:    s.SystemConf.GetElasticContext(),
-			AzureMonitor:    s.SystemConf.GetAzureMonitorContext(),
-			PromConfig:      s.SystemConf.GetPromContext(),
+			TSDBContext:      s.SystemConf.GetTSDBContext(),
+			GraphiteContext:  s.SystemConf.GetGraphiteContext(),
+			GraphiteFailover: s.SystemConf.GetGraphiteFailoverContexts(),
+			GraphiteConfig:   s.SystemConf.GetGraphiteConfig(),
+			InfluxConfig:     s.SystemConf.GetInfluxContext(),
+			ElasticHosts:     s.SystemConf.GetElasticContext(),
+			AzureMonitor:     s.SystemConf.GetAzureMonitorContext(),
+			PromConfig:       s.SystemConf.GetPromContext(),
 		},
 	}
 	return r
@@ -670,7 +672,13 @@ func (s *Schedule) executeExpr(T miniprofiler.Timer, rh *RunHistory, a *conf.Ale
 		Annotate:  s.annotate,
 	}
 	origin := fmt.Sprintf("Schedule: Alert Name: %s", a.Name)
-	results, _, err := e.Execute(rh.Backends, providers, T, rh.Start, 0, a.UnjoinedOK, origin)
+	// stop the queries of the check when bosun shuts down or reloads
+	results, _, err := e.ExecuteContext(s.runnerContext, rh.Backends, providers, T, rh.Start, 0, a.UnjoinedOK, origin)
+	if expr.IsNoData(err) {
+		// like a query returning no series, this leaves it to the unknown
+		// checks to notice the missing data
+		return &expr.Results{}, nil
+	}
 	return results, err
 }
 
@@ -11,6 +11,8 @@ import (
 
 	"bosun.org/cmd/bosun/conf"
 	"bosun.org/cmd/bosun/conf/rule"
+	"bosun.org/cmd/bosun/expr"
+	"bosun.org/graphite"
 	"bosun.org/models"
 	"bosun.org/opentsdb"
 )
@@ -596,3 +598,40 @@ Loop:
 		}
 	}
 }
+
+type graphiteCheckContext struct {
+	err error
+}
+
+func (c graphiteCheckContext) Query(r *graphite.Request) (graphite.Response, error) {
+	return graphite.Response{}, c.err
+}
+
+func TestExecuteExprGraphiteNoData(t *testing.T) {
+	defer setup()()
+	c, err := rule.NewConf("", conf.EnabledBackends{Graphite: true}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, _ := initSched(&conf.SystemConf{}, c)
+	e, err := expr.New(`graphite("*", "5m", "", "host")`, c.GetFuncs(conf.EnabledBackends{Graphite: true}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rh := s.NewRunHistory(utcNow(), nil)
+	rh.Backends.GraphiteContext = graphiteCheckContext{}
+	results, err := s.executeExpr(nil, rh, &conf.Alert{}, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results.Results) != 0 {
+		t.Errorf("expected no results, got %v", results.Results)
+	}
+	// the failover cluster answering empty after the primary failed is an error
+	rh = s.NewRunHistory(utcNow(), nil)
+	rh.Backends.GraphiteContext = graphiteCheckContext{&graphite.RequestError{StatusCode: http.StatusServiceUnavailable, Msg: "graphite unavailable"}}
+	rh.Backends.GraphiteFailover = []graphite.Context{graphiteCheckContext{}}
+	if _, err := s.executeExpr(nil, rh, &conf.Alert{}, e); err == nil {
+		t.Error("expected an error")
+	}
+}
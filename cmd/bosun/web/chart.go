@@ -240,12 +240,14 @@ func ExprGraph(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (in
 	}
 	// it may not strictly be necessary to recreate the contexts each time, but we do to be safe
 	backends := &expr.Backends{
-		TSDBContext:     schedule.SystemConf.GetTSDBContext(),
-		GraphiteContext: schedule.SystemConf.GetGraphiteContext(),
-		InfluxConfig:    schedule.SystemConf.GetInfluxContext(),
-		ElasticHosts:    schedule.SystemConf.GetElasticContext(),
-		AzureMonitor:    schedule.SystemConf.GetAzureMonitorContext(),
-		PromConfig:      schedule.SystemConf.GetPromContext(),
+		TSDBContext:      schedule.SystemConf.GetTSDBContext(),
+		GraphiteContext:  schedule.SystemConf.GetGraphiteContext(),
+		GraphiteFailover: schedule.SystemConf.GetGraphiteFailoverContexts(),
+		GraphiteConfig:   schedule.SystemConf.GetGraphiteConfig(),
+		InfluxConfig:     schedule.SystemConf.GetInfluxContext(),
+		ElasticHosts:     schedule.SystemConf.GetElasticContext(),
+		AzureMonitor:     schedule.SystemConf.GetAzureMonitorContext(),
+		PromConfig:       schedule.SystemConf.GetPromContext(),
 	}
 	providers := &expr.BosunProviders{
 		Cache:     cacheObj,
@@ -82,12 +82,14 @@ func Expr(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (v inter
 	}
 	// it may not strictly be necessary to recreate the contexts each time, but we do to be safe
 	backends := &expr.Backends{
-		TSDBContext:     schedule.SystemConf.GetTSDBContext(),
-		GraphiteContext: schedule.SystemConf.GetGraphiteContext(),
-		InfluxConfig:    schedule.SystemConf.GetInfluxContext(),
-		ElasticHosts:    schedule.SystemConf.GetElasticContext(),
-		AzureMonitor:    schedule.SystemConf.GetAzureMonitorContext(),
-		PromConfig:      schedule.SystemConf.GetPromContext(),
+		TSDBContext:      schedule.SystemConf.GetTSDBContext(),
+		GraphiteContext:  schedule.SystemConf.GetGraphiteContext(),
+		GraphiteFailover: schedule.SystemConf.GetGraphiteFailoverContexts(),
+		GraphiteConfig:   schedule.SystemConf.GetGraphiteConfig(),
+		InfluxConfig:     schedule.SystemConf.GetInfluxContext(),
+		ElasticHosts:     schedule.SystemConf.GetElasticContext(),
+		AzureMonitor:     schedule.SystemConf.GetAzureMonitorContext(),
+		PromConfig:       schedule.SystemConf.GetPromContext(),
 	}
 	providers := &expr.BosunProviders{
 		Cache:     cacheObj,
@@ -96,7 +98,7 @@ func Expr(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (v inter
 		History:   nil,
 		Annotate:  AnnotateBackend,
 	}
-	res, queries, err := e.Execute(backends, providers, t, now, 0, false, "Web: expression execution")
+	res, queries, err := e.ExecuteContext(r.Context(), backends, providers, t, now, 0, false, "Web: expression execution")
 	if err != nil {
 		return nil, err
 	}
@@ -531,3 +533,33 @@ func buildConfig(r *http.Request) (c conf.RuleConfProvider, a *conf.Alert, hash
 	return c, a, hash, nil
 
 }
+
+// GraphiteEstimate estimates how many series and datapoints the graphite
+// query q fetches from start to end, durations before now, at a resolution
+// of step. start defaults to 1h, end to now and step to 1m.
+func GraphiteEstimate(t miniprofiler.Timer, w http.ResponseWriter, r *http.Request) (interface{}, error) {
+	c := schedule.SystemConf.GetGraphiteContext()
+	if c == nil {
+		return nil, fmt.Errorf("graphite is not configured")
+	}
+	q := r.FormValue("q")
+	if q == "" {
+		return nil, fmt.Errorf("missing query")
+	}
+	durations := map[string]string{"start": "1h", "end": "0s", "step": "1m"}
+	for k := range durations {
+		if v := r.FormValue(k); v != "" {
+			durations[k] = v
+		}
+	}
+	parsed := make(map[string]time.Duration, len(durations))
+	for k, v := range durations {
+		d, err := opentsdb.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", k, err)
+		}
+		parsed[k] = time.Duration(d)
+	}
+	now := time.Now().UTC()
+	return expr.EstimateGraphiteQuery(r.Context(), c, q, now.Add(-parsed["start"]), now.Add(-parsed["end"]), parsed["step"])
+}
@@ -152,6 +152,7 @@ func Listen(httpAddr, httpsAddr, certFile, keyFile string, devMode bool, tsdbHos
 	handle("/api/errors", JSON(ErrorHistory), canViewDash).Name("errors").Methods(GET, POST)
 	handle("/api/expr", JSON(Expr), canRunTests).Name("expr").Methods(POST)
 	handle("/api/graph", JSON(Graph), canViewDash).Name("graph").Methods(GET)
+	handle("/api/graphite/estimate", JSON(GraphiteEstimate), canRunTests).Name("graphite_estimate").Methods(GET)
 
 	handle("/api/health", JSON(HealthCheck), fullyOpen).Name("health_check").Methods(GET)
 	handle("/api/host", JSON(Host), canViewDash).Name("host").Methods(GET)
@@ -2,37 +2,214 @@
 package graphite // import "bosun.org/graphite"
 
 import (
+	"compress/gzip"
+	"context"
+	"encoding/csv"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 )
 
 const requestErrFmt = "graphite RequestError (%s): %s"
 
-// Request holds query objects. Currently only absolute times are supported.
+// RequestError is returned when a request could not be sent to Graphite, or
+// Graphite answered it with an error status. StatusCode is 0 in the first
+// case.
+type RequestError struct {
+	URL        *url.URL
+	StatusCode int
+	Msg        string
+}
+
+func (err *RequestError) Error() string {
+	return fmt.Sprintf(requestErrFmt, err.URL, err.Msg)
+}
+
+// Request holds query objects. Start and End give an absolute time range. If
+// they are nil, From and Until are passed to Graphite as is, so they may use
+// any time format Graphite understands, like "-1h" or "midnight".
 type Request struct {
 	Start   *time.Time
 	End     *time.Time
+	From    string
+	Until   string
 	Targets []string
 	URL     *url.URL
+	// MaxDataPoints, when non-zero, asks Graphite to consolidate each
+	// series down to at most this many datapoints.
+	MaxDataPoints int
+	// Timeout, when non-zero, is how long callers wait for the query before
+	// cancelling it. It is not sent to Graphite.
+	Timeout time.Duration
+	// Location, if not nil, is the time zone Graphite uses for the request,
+	// for example to find midnight for From and Until.
+	Location *time.Location `json:"-"`
+	// Template holds values for the $variables of the targets, sent to
+	// Graphite as template[name]=value parameters.
+	Template map[string]string
+	// CSV requests the response as CSV instead of JSON, which is more
+	// compact for queries returning many datapoints.
+	CSV bool
+	// NoNullPoints asks Graphite to leave out None datapoints, and series
+	// that only have None datapoints. Those series are then missing from the
+	// response instead of being returned without datapoints.
+	NoNullPoints bool
+	// ConsolidateBy, if set, is the function graphite consolidates the
+	// datapoints of each series with, such as max or sum, instead of
+	// averaging them. The targets are sent wrapped in consolidateBy(), which
+	// is removed again from the targets of the response.
+	ConsolidateBy string
+	// Header holds headers sent with this request in addition to, and
+	// replacing, the ones of the host. It is not part of the cache key.
+	Header http.Header `json:"-"`
+	// Bytes is increased by each query of r by the size of the response
+	// body read from Graphite, before it is decompressed.
+	Bytes int64 `json:"-"`
 }
 
 type Response []Series
 
 type Series struct {
-	Datapoints []DataPoint
-	Target     string
+	Datapoints []DataPoint `json:"datapoints"`
+	Target     string      `json:"target"`
+	// Tags are the tags of the series as returned by graphite 1.1 and later.
+	Tags map[string]string `json:"tags,omitempty"`
 }
 
 type DataPoint []json.Number
 
+// MarshalJSON encodes d like graphite does, with null for None values, which
+// are empty after decoding.
+func (d DataPoint) MarshalJSON() ([]byte, error) {
+	b := []byte{'['}
+	for i, n := range d {
+		if i > 0 {
+			b = append(b, ',')
+		}
+		if n == "" {
+			b = append(b, "null"...)
+			continue
+		}
+		v, err := json.Marshal(n)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, v...)
+	}
+	return append(b, ']'), nil
+}
+
+// CacheKey identifies the raw response to r. It doesn't cover how the
+// response is parsed, so caches of parsed results must add that to the key.
 func (r *Request) CacheKey() string {
-	targets, _ := json.Marshal(r.Targets)
-	return fmt.Sprintf("graphite-%d-%d-%s", r.Start.Unix(), r.End.Unix(), targets)
+	return r.CacheKeyTimeRange(r.from() + "-" + r.until())
+}
+
+// CacheKeyTimeRange is like CacheKey but identifies the time range of r with
+// timeRange, for caches of requests whose times move with when they are sent.
+func (r *Request) CacheKeyTimeRange(timeRange string) string {
+	normalized := make([]string, len(r.Targets))
+	for i, t := range r.Targets {
+		normalized[i] = normalizeTarget(t)
+	}
+	targets, _ := json.Marshal(normalized)
+	key := fmt.Sprintf("graphite-%s-%d-%s", timeRange, r.MaxDataPoints, targets)
+	if r.Location != nil {
+		key += "-" + r.Location.String()
+	}
+	if r.NoNullPoints {
+		key += "-noNullPoints"
+	}
+	if r.ConsolidateBy != "" {
+		key += "-consolidateBy-" + r.ConsolidateBy
+	}
+	if len(r.Template) > 0 {
+		// maps are marshalled in key order
+		template, _ := json.Marshal(r.Template)
+		key += "-" + string(template)
+	}
+	return key
+}
+
+// unconsolidateTarget returns the target graphite named a series wrapped in
+// consolidateBy with function fn, like consolidateBy(a.b,"max"), without it.
+func unconsolidateTarget(target, fn string) string {
+	if !strings.HasPrefix(target, "consolidateBy(") {
+		return target
+	}
+	for _, q := range []string{`"`, "'"} {
+		suffix := "," + q + fn + q + ")"
+		if strings.HasSuffix(target, suffix) {
+			return strings.TrimSuffix(strings.TrimPrefix(target, "consolidateBy("), suffix)
+		}
+	}
+	return target
+}
+
+// normalizeTarget returns target without the whitespace around parentheses
+// and commas and at its ends, which Graphite ignores, so targets that only
+// differ in it share a cache key. Quoted strings are left as they are.
+func normalizeTarget(target string) string {
+	var b strings.Builder
+	var quote byte
+	// pending is whitespace that is only kept if no separator follows
+	pending := ""
+	separated := true
+	for i := 0; i < len(target); i++ {
+		c := target[i]
+		if quote != 0 {
+			b.WriteByte(c)
+			if c == '\\' && i+1 < len(target) {
+				i++
+				b.WriteByte(target[i])
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case ' ', '\t', '\n', '\r':
+			if !separated {
+				pending += string(c)
+			}
+			continue
+		case '(', ')', ',':
+			pending = ""
+			b.WriteByte(c)
+			separated = true
+			continue
+		case '"', '\'':
+			quote = c
+		}
+		b.WriteString(pending)
+		pending = ""
+		b.WriteByte(c)
+		separated = false
+	}
+	return b.String()
+}
+
+// from returns the from parameter sent to Graphite.
+func (r *Request) from() string {
+	if r.Start != nil {
+		return fmt.Sprint(r.Start.Unix())
+	}
+	return r.From
+}
+
+// until returns the until parameter sent to Graphite.
+func (r *Request) until() string {
+	if r.End != nil {
+		return fmt.Sprint(r.End.Unix())
+	}
+	return r.Until
 }
 
 // Query performs a request to Graphite at the given host. host specifies
@@ -40,56 +217,449 @@ func (r *Request) CacheKey() string {
 // (http, https) to specify the protocol (http is the default). header is
 // the headers to send.
 func (r *Request) Query(host string, header http.Header) (Response, error) {
+	return r.QueryContext(context.Background(), host, header)
+}
+
+// QueryContext is like Query but the request is cancelled when ctx is done.
+func (r *Request) QueryContext(ctx context.Context, host string, header http.Header) (Response, error) {
+	return r.query(ctx, host, header, Paths{})
+}
+
+func (r *Request) query(ctx context.Context, host string, header http.Header, paths Paths) (Response, error) {
+	var series Response
+	err := r.queryStream(ctx, host, header, paths, func(s Series) error {
+		series = append(series, s)
+		return nil
+	})
+	return series, err
+}
+
+// QueryStream is like QueryContext but calls fn with each series as it is
+// decoded, so the whole response never has to be held in memory. If fn
+// returns an error the request is stopped and the error is returned.
+func (r *Request) QueryStream(ctx context.Context, host string, header http.Header, fn func(Series) error) error {
+	return r.queryStream(ctx, host, header, Paths{}, fn)
+}
+
+func (r *Request) queryStream(ctx context.Context, host string, header http.Header, paths Paths, fn func(Series) error) error {
 	v := url.Values{
 		"format": []string{"json"},
 		"target": r.Targets,
 	}
+	if r.ConsolidateBy != "" {
+		targets := make([]string, len(r.Targets))
+		for i, t := range r.Targets {
+			targets[i] = fmt.Sprintf("consolidateBy(%s,'%s')", t, r.ConsolidateBy)
+		}
+		v["target"] = targets
+		consolidated := fn
+		fn = func(s Series) error {
+			s.Target = unconsolidateTarget(s.Target, r.ConsolidateBy)
+			return consolidated(s)
+		}
+	}
+	if r.CSV {
+		v.Set("format", "csv")
+		if r.Location == nil {
+			// CSV timestamps are formatted in the time zone of the request
+			v.Add("tz", "UTC")
+		}
+	}
+	if from := r.from(); from != "" {
+		v.Add("from", from)
+	}
+	if until := r.until(); until != "" {
+		v.Add("until", until)
+	}
+	if r.MaxDataPoints > 0 {
+		v.Add("maxDataPoints", fmt.Sprint(r.MaxDataPoints))
+	}
+	if r.Location != nil {
+		v.Add("tz", r.Location.String())
+	}
+	if r.NoNullPoints {
+		v.Add("noNullPoints", "true")
+	}
+	for name, value := range r.Template {
+		v.Add("template["+name+"]", value)
+	}
+	if len(r.Header) > 0 {
+		h := make(http.Header, len(header)+len(r.Header))
+		for k, v := range header {
+			h[k] = v
+		}
+		for k, v := range r.Header {
+			h[k] = v
+		}
+		header = h
+	}
+	var user *url.Userinfo
+	r.URL, user = requestURL(host, "render", paths, v)
+	return get(ctx, r.URL, user, unixSocket(host), header, &r.Bytes, func(body io.Reader) error {
+		if r.CSV {
+			loc := r.Location
+			if loc == nil {
+				loc = time.UTC
+			}
+			return decodeCSVSeries(body, loc, r.URL, fn)
+		}
+		return decodeSeries(json.NewDecoder(body), r.URL, fn)
+	})
+}
+
+// decodeSeries decodes the series of a render response from d one by one.
+func decodeSeries(d *json.Decoder, u *url.URL, fn func(Series) error) error {
+	decodeErr := func(err error) error {
+		return fmt.Errorf(requestErrFmt, u, "Json decode failed: "+err.Error())
+	}
+	if t, err := d.Token(); err != nil {
+		return decodeErr(err)
+	} else if t != json.Delim('[') {
+		return decodeErr(fmt.Errorf("expected a list of series, got %v", t))
+	}
+	for d.More() {
+		var s Series
+		if err := d.Decode(&s); err != nil {
+			return decodeErr(err)
+		}
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+	if _, err := d.Token(); err != nil {
+		return decodeErr(err)
+	}
+	return nil
+}
+
+// graphiteCSVTime is the format of timestamps in CSV responses.
+const graphiteCSVTime = "2006-01-02 15:04:05"
+
+// decodeCSVSeries decodes the series of a CSV render response, which has a
+// target,timestamp,value row for every datapoint, from body one by one.
+// Timestamps are in loc.
+func decodeCSVSeries(body io.Reader, loc *time.Location, u *url.URL, fn func(Series) error) error {
+	decodeErr := func(err error) error {
+		return fmt.Errorf(requestErrFmt, u, "CSV decode failed: "+err.Error())
+	}
+	cr := csv.NewReader(body)
+	cr.FieldsPerRecord = 3
+	cr.ReuseRecord = true
+	var s *Series
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return decodeErr(err)
+		}
+		if s != nil && row[0] != s.Target {
+			if err := fn(*s); err != nil {
+				return err
+			}
+			s = nil
+		}
+		if s == nil {
+			s = &Series{Target: row[0], Datapoints: []DataPoint{}}
+		}
+		t, err := time.ParseInLocation(graphiteCSVTime, row[1], loc)
+		if err != nil {
+			return decodeErr(err)
+		}
+		s.Datapoints = append(s.Datapoints, DataPoint{json.Number(row[2]), json.Number(fmt.Sprint(t.Unix()))})
+	}
+	if s != nil {
+		return fn(*s)
+	}
+	return nil
+}
+
+// FindRequest asks Graphite which metrics match Query, which may contain
+// wildcards, without fetching their datapoints.
+type FindRequest struct {
+	Query string
+	URL   *url.URL
+}
+
+// Metric is a node of the metric tree returned by a FindRequest.
+type Metric struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+	// Leaf is 1 for metrics and 0 for nodes that only have children.
+	Leaf int `json:"leaf"`
+}
+
+// Find performs a find request to Graphite at host, which is given as for
+// Request.Query.
+func (r *FindRequest) Find(ctx context.Context, host string, header http.Header) ([]Metric, error) {
+	return r.find(ctx, host, header, Paths{})
+}
+
+func (r *FindRequest) find(ctx context.Context, host string, header http.Header, paths Paths) ([]Metric, error) {
+	v := url.Values{
+		"format": []string{"treejson"},
+		"query":  []string{r.Query},
+	}
+	var user *url.Userinfo
+	r.URL, user = requestURL(host, "metrics/find", paths, v)
+	var metrics []Metric
+	err := get(ctx, r.URL, user, unixSocket(host), header, nil, func(body io.Reader) error {
+		if err := json.NewDecoder(body).Decode(&metrics); err != nil {
+			return fmt.Errorf(requestErrFmt, r.URL, "Json decode failed: "+err.Error())
+		}
+		return nil
+	})
+	return metrics, err
+}
+
+// Paths overrides where the endpoints of a Graphite server are, for
+// Graphite compatible backends that serve them elsewhere.
+type Paths struct {
+	// Render, if set, is the path of the render endpoint, like /api/render.
+	Render string
+	// Prefix, if set, is prepended to the paths of the other endpoints,
+	// like /api for /api/metrics/find/.
+	Prefix string
+}
+
+// ExpandRequest asks Graphite which metric paths Query, which may contain
+// wildcards, expands to.
+type ExpandRequest struct {
+	Query string
+	URL   *url.URL
+}
+
+// Expand performs an expand request to Graphite at host, which is given as
+// for Request.Query, and returns the paths of the metrics matching r.Query.
+func (r *ExpandRequest) Expand(ctx context.Context, host string, header http.Header) ([]string, error) {
+	return r.expand(ctx, host, header, Paths{})
+}
+
+func (r *ExpandRequest) expand(ctx context.Context, host string, header http.Header, paths Paths) ([]string, error) {
+	v := url.Values{
+		"query":      []string{r.Query},
+		"leavesOnly": []string{"1"},
+	}
+	var user *url.Userinfo
+	r.URL, user = requestURL(host, "metrics/expand", paths, v)
+	var expanded struct {
+		Results []string `json:"results"`
+	}
+	err := get(ctx, r.URL, user, unixSocket(host), header, nil, func(body io.Reader) error {
+		if err := json.NewDecoder(body).Decode(&expanded); err != nil {
+			return fmt.Errorf(requestErrFmt, r.URL, "Json decode failed: "+err.Error())
+		}
+		return nil
+	})
+	return expanded.Results, err
+}
+
+// EventsRequest asks Graphite for the events from Start to End, those with
+// Tags if any are given.
+type EventsRequest struct {
+	Start *time.Time
+	End   *time.Time
+	Tags  []string
+	URL   *url.URL
+}
+
+// Event is an event of graphite's events API, like a deployment.
+type Event struct {
+	ID   int       `json:"id"`
+	When float64   `json:"when"`
+	What string    `json:"what"`
+	Data string    `json:"data"`
+	Tags EventTags `json:"tags"`
+}
+
+// EventTags are the tags of an event. Graphite 1.1 and later return them as a
+// list, older versions as a space separated string.
+type EventTags []string
+
+func (t *EventTags) UnmarshalJSON(b []byte) error {
+	var tags []string
+	if err := json.Unmarshal(b, &tags); err == nil {
+		*t = tags
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	*t = strings.Fields(s)
+	return nil
+}
+
+// Events performs an events request to Graphite at host, which is given as
+// for Request.Query.
+func (r *EventsRequest) Events(ctx context.Context, host string, header http.Header) ([]Event, error) {
+	return r.events(ctx, host, header, Paths{})
+}
+
+func (r *EventsRequest) events(ctx context.Context, host string, header http.Header, paths Paths) ([]Event, error) {
+	v := url.Values{}
 	if r.Start != nil {
 		v.Add("from", fmt.Sprint(r.Start.Unix()))
 	}
 	if r.End != nil {
 		v.Add("until", fmt.Sprint(r.End.Unix()))
 	}
-	r.URL = &url.URL{
+	if len(r.Tags) > 0 {
+		v.Add("tags", strings.Join(r.Tags, " "))
+	}
+	var user *url.Userinfo
+	r.URL, user = requestURL(host, "events/get_data", paths, v)
+	var events []Event
+	err := get(ctx, r.URL, user, unixSocket(host), header, nil, func(body io.Reader) error {
+		if err := json.NewDecoder(body).Decode(&events); err != nil {
+			return fmt.Errorf(requestErrFmt, r.URL, "Json decode failed: "+err.Error())
+		}
+		return nil
+	})
+	return events, err
+}
+
+// requestURL returns the URL of the endpoint of the Graphite server at host.
+// If host is a URL with a path, that path is used for the render endpoint and
+// other endpoints are relative to it, unless paths says otherwise.
+// Credentials in host are returned separately so they don't end up in error
+// messages or query logs.
+func requestURL(host, endpoint string, paths Paths, v url.Values) (u *url.URL, user *url.Userinfo) {
+	path := endpoint + "/"
+	if endpoint == "events/get_data" {
+		// unlike the other endpoints it doesn't match with a trailing slash
+		path = endpoint
+	}
+	u = &url.URL{
 		Scheme:   "http",
 		Host:     host,
-		Path:     "/render/",
+		Path:     "/" + path,
 		RawQuery: v.Encode(),
 	}
-	if u, _ := url.Parse(host); u.Scheme != "" && u.Host != "" {
-		r.URL.Scheme = u.Scheme
-		r.URL.Host = u.Host
-		if u.Path != "" {
-			r.URL.Path = u.Path
+	defer func() {
+		switch {
+		case endpoint == "render" && paths.Render != "":
+			u.Path = paths.Render
+		case endpoint != "render" && paths.Prefix != "":
+			u.Path = strings.TrimSuffix(paths.Prefix, "/") + "/" + path
+		}
+	}()
+	if unixSocket(host) != "" {
+		// the host name is ignored, the connection is made to the socket
+		u.Host = "unix"
+		return u, nil
+	}
+	if h, _ := url.Parse(host); h.Scheme != "" && h.Host != "" {
+		u.Scheme = h.Scheme
+		u.Host = h.Host
+		if h.Path != "" {
+			u.Path = h.Path
+			if endpoint != "render" {
+				u.Path = strings.TrimSuffix(strings.TrimSuffix(h.Path, "/"), "/render") + "/" + path
+			}
 		}
-		r.URL.User = u.User
+		return u, h.User
+	}
+	return u, nil
+}
+
+// unixSocket returns the path of the Unix domain socket of a host given as a
+// unix URL, like unix:///run/graphite.sock, and "" for other hosts.
+func unixSocket(host string) string {
+	if !strings.HasPrefix(host, "unix://") {
+		return ""
 	}
-	req, err := http.NewRequest("GET", r.URL.String(), nil)
+	if h, err := url.Parse(host); err == nil {
+		return h.Path
+	}
+	return ""
+}
+
+// unixClients are the HTTP clients for the Unix domain sockets requests were
+// made to, by socket path.
+var unixClients sync.Map
+
+// unixClient returns a client like DefaultClient that connects to socket.
+func unixClient(socket string) *http.Client {
+	if c, ok := unixClients.Load(socket); ok {
+		return c.(*http.Client)
+	}
+	c, _ := unixClients.LoadOrStore(socket, &http.Client{
+		Timeout: DefaultClient.Timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		},
+	})
+	return c.(*http.Client)
+}
+
+// get requests u from Graphite, authenticating as user if it is not nil, and
+// calls decode with the body of the response. If socket is set, the request
+// is sent over that Unix domain socket. If read is not nil, the number of
+// bytes of the body read is added to it.
+func get(ctx context.Context, u *url.URL, user *url.Userinfo, socket string, header http.Header, read *int64, decode func(io.Reader) error) error {
+	req, err := http.NewRequest("GET", u.String(), nil)
 	if err != nil {
-		return nil, fmt.Errorf(requestErrFmt, r.URL, "NewRequest failed: "+err.Error())
+		return fmt.Errorf(requestErrFmt, u, "NewRequest failed: "+err.Error())
+	}
+	// header is shared between requests, so copy it before adding to it
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	// asking for gzip ourselves means the transport leaves decompressing to
+	// us, even if header already asks for some encoding
+	req.Header.Set("Accept-Encoding", "gzip")
+	if user != nil {
+		password, _ := user.Password()
+		req.SetBasicAuth(user.Username(), password)
 	}
-	if header != nil {
-		req.Header = header
+	client := DefaultClient
+	if socket != "" {
+		client = unixClient(socket)
 	}
-	resp, err := DefaultClient.Do(req)
+	resp, err := client.Do(req.WithContext(ctx))
 	if err != nil {
-		return nil, fmt.Errorf(requestErrFmt, r.URL, "Get failed: "+err.Error())
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return &RequestError{URL: u, Msg: "Get failed: " + err.Error()}
 	}
 	defer resp.Body.Close()
+	if read != nil {
+		resp.Body = &countingReader{ReadCloser: resp.Body, n: read}
+	}
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return fmt.Errorf(requestErrFmt, u, "gzip decode failed: "+err.Error())
+		}
+		defer gz.Close()
+		resp.Body = gz
+	}
 	if resp.StatusCode != http.StatusOK {
 		tb, err := readTraceback(resp)
 		if err != nil {
 			tb = &[]string{"<Could not read traceback: " + err.Error() + ">"}
 		}
-		return nil, fmt.Errorf(requestErrFmt, r.URL, fmt.Sprintf("Get failed: %s\n%s", resp.Status, strings.Join(*tb, "\n")))
-	}
-	var series Response
-	err = json.NewDecoder(resp.Body).Decode(&series)
-	if err != nil {
-		e := fmt.Errorf(requestErrFmt, r.URL, "Json decode failed: "+err.Error())
-		return series, e
+		return &RequestError{URL: u, StatusCode: resp.StatusCode, Msg: fmt.Sprintf("Get failed: %s\n%s", resp.Status, strings.Join(*tb, "\n"))}
 	}
-	return series, nil
+	return decode(resp.Body)
+}
+
+// countingReader adds the number of bytes read from it to n.
+type countingReader struct {
+	io.ReadCloser
+	n *int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	*r.n += int64(n)
+	return n, err
 }
 
 func readTraceback(resp *http.Response) (*[]string, error) {
@@ -126,6 +696,86 @@ type Context interface {
 	Query(*Request) (Response, error)
 }
 
+// ContextQueryer is implemented by Contexts whose queries can be cancelled.
+type ContextQueryer interface {
+	QueryContext(context.Context, *Request) (Response, error)
+}
+
+// QueryContext queries c with r, cancelling the query when ctx is done if c
+// supports it.
+func QueryContext(ctx context.Context, c Context, r *Request) (Response, error) {
+	if cq, ok := c.(ContextQueryer); ok {
+		return cq.QueryContext(ctx, r)
+	}
+	return c.Query(r)
+}
+
+// Streamer is implemented by Contexts that can return the series of a
+// response one by one as they are decoded.
+type Streamer interface {
+	QueryStream(context.Context, *Request, func(Series) error) error
+}
+
+// QueryStream queries c with r and calls fn with every series of the
+// response, streaming them if c supports it.
+func QueryStream(ctx context.Context, c Context, r *Request, fn func(Series) error) error {
+	if s, ok := c.(Streamer); ok {
+		return s.QueryStream(ctx, r, fn)
+	}
+	resp, err := QueryContext(ctx, c, r)
+	if err != nil {
+		return err
+	}
+	for _, s := range resp {
+		if err := fn(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Finder is implemented by Contexts that can find metrics.
+type Finder interface {
+	Find(context.Context, *FindRequest) ([]Metric, error)
+}
+
+// Find finds the metrics matching r in c.
+func Find(ctx context.Context, c Context, r *FindRequest) ([]Metric, error) {
+	f, ok := c.(Finder)
+	if !ok {
+		return nil, fmt.Errorf("graphite: finding metrics is not supported by %T", c)
+	}
+	return f.Find(ctx, r)
+}
+
+// Expander is implemented by Contexts that can expand metric paths.
+type Expander interface {
+	Expand(context.Context, *ExpandRequest) ([]string, error)
+}
+
+// Expand returns the paths of the metrics matching r in c.
+func Expand(ctx context.Context, c Context, r *ExpandRequest) ([]string, error) {
+	ex, ok := c.(Expander)
+	if !ok {
+		return nil, fmt.Errorf("graphite: expanding metric paths is not supported by %T", c)
+	}
+	return ex.Expand(ctx, r)
+}
+
+// Eventer is implemented by Contexts that can get events.
+type Eventer interface {
+	Events(context.Context, *EventsRequest) ([]Event, error)
+}
+
+// Events gets the events matching r from c.
+func Events(ctx context.Context, c Context, r *EventsRequest) ([]Event, error) {
+	ev, ok := c.(Eventer)
+	if !ok {
+		return nil, fmt.Errorf("graphite: getting events is not supported by %T", c)
+	}
+	return ev.Events(ctx, r)
+}
+
 // Host is a simple Graphite Context with no additional features.
 type Host string
 
@@ -134,11 +784,60 @@ func (h Host) Query(r *Request) (Response, error) {
 	return r.Query(string(h), nil)
 }
 
+// QueryContext performs a request to a Graphite server that is cancelled
+// when ctx is done.
+func (h Host) QueryContext(ctx context.Context, r *Request) (Response, error) {
+	return r.QueryContext(ctx, string(h), nil)
+}
+
+// QueryStream performs a request to a Graphite server, calling fn with each
+// series of the response.
+func (h Host) QueryStream(ctx context.Context, r *Request, fn func(Series) error) error {
+	return r.QueryStream(ctx, string(h), nil, fn)
+}
+
+// Find performs a find request to a Graphite server.
+func (h Host) Find(ctx context.Context, r *FindRequest) ([]Metric, error) {
+	return r.Find(ctx, string(h), nil)
+}
+
+// Expand performs an expand request to a Graphite server.
+func (h Host) Expand(ctx context.Context, r *ExpandRequest) ([]string, error) {
+	return r.Expand(ctx, string(h), nil)
+}
+
+// Events performs an events request to a Graphite server.
+func (h Host) Events(ctx context.Context, r *EventsRequest) ([]Event, error) {
+	return r.Events(ctx, string(h), nil)
+}
+
 type HostHeader struct {
 	Host   string
 	Header http.Header
+	// Paths, if set, overrides the paths of the endpoints of Host.
+	Paths Paths
 }
 
 func (h HostHeader) Query(r *Request) (Response, error) {
-	return r.Query(h.Host, h.Header)
+	return r.query(context.Background(), h.Host, h.Header, h.Paths)
+}
+
+func (h HostHeader) QueryContext(ctx context.Context, r *Request) (Response, error) {
+	return r.query(ctx, h.Host, h.Header, h.Paths)
+}
+
+func (h HostHeader) QueryStream(ctx context.Context, r *Request, fn func(Series) error) error {
+	return r.queryStream(ctx, h.Host, h.Header, h.Paths, fn)
+}
+
+func (h HostHeader) Find(ctx context.Context, r *FindRequest) ([]Metric, error) {
+	return r.find(ctx, h.Host, h.Header, h.Paths)
+}
+
+func (h HostHeader) Expand(ctx context.Context, r *ExpandRequest) ([]string, error) {
+	return r.expand(ctx, h.Host, h.Header, h.Paths)
+}
+
+func (h HostHeader) Events(ctx context.Context, r *EventsRequest) ([]Event, error) {
+	return r.events(ctx, h.Host, h.Header, h.Paths)
 }
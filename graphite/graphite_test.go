@@ -0,0 +1,391 @@
+package graphite
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryGzip(t *testing.T) {
+	const body = `[{"target": "web01.cpu", "datapoints": [[1, 100], [2, 160]]}]`
+	for _, compress := range []bool{true, false} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if got := r.Header.Get("Accept-Encoding"); got != "gzip" {
+				t.Errorf("Accept-Encoding = %q, want gzip", got)
+			}
+			if !compress {
+				w.Write([]byte(body))
+				return
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			gz.Write([]byte(body))
+			gz.Close()
+		}))
+		header := http.Header{"X-Test": []string{"1"}}
+		r := &Request{Targets: []string{"web01.cpu"}}
+		resp, err := r.Query(ts.URL, header)
+		ts.Close()
+		if err != nil {
+			t.Fatalf("compress=%v: %v", compress, err)
+		}
+		if len(resp) != 1 || resp[0].Target != "web01.cpu" || len(resp[0].Datapoints) != 2 {
+			t.Errorf("compress=%v: unexpected response %v", compress, resp)
+		}
+		if len(header) != 1 {
+			t.Errorf("compress=%v: shared header was modified: %v", compress, header)
+		}
+	}
+}
+
+func TestQueryStream(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"target": "a", "datapoints": [[1, 100]]}, {"target": "b", "datapoints": []}, {"target": "c"}]`))
+	}))
+	defer ts.Close()
+	r := &Request{Targets: []string{"*"}}
+	var targets []string
+	err := r.QueryStream(context.Background(), ts.URL, nil, func(s Series) error {
+		targets = append(targets, s.Target)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(targets, ",") != "a,b,c" {
+		t.Errorf("unexpected targets %v", targets)
+	}
+	stop := errors.New("stop")
+	targets = nil
+	err = r.QueryStream(context.Background(), ts.URL, nil, func(s Series) error {
+		targets = append(targets, s.Target)
+		return stop
+	})
+	if err != stop || len(targets) != 1 {
+		t.Errorf("expected to stop after the first series, got %v %v", targets, err)
+	}
+}
+
+func TestQueryLocation(t *testing.T) {
+	var tz string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tz = r.URL.Query().Get("tz")
+		w.Write([]byte(`[]`))
+	}))
+	defer ts.Close()
+	r := &Request{Targets: []string{"web01.cpu"}, From: "midnight"}
+	key := r.CacheKey()
+	r.Location = time.FixedZone("Test/Zone", 3600)
+	if _, err := r.Query(ts.URL, nil); err != nil {
+		t.Fatal(err)
+	}
+	if tz != "Test/Zone" {
+		t.Errorf("expected tz Test/Zone, got %q", tz)
+	}
+	if r.CacheKey() == key {
+		t.Error("expected the time zone to change the cache key")
+	}
+}
+
+func TestQueryCSV(t *testing.T) {
+	var format, tz string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format, tz = r.URL.Query().Get("format"), r.URL.Query().Get("tz")
+		w.Write([]byte("web01.cpu,1970-01-01 00:01:40,1.5\r\nweb01.cpu,1970-01-01 00:02:40,\r\n\"sumSeries(a,b)\",1970-01-01 00:01:40,3\r\n"))
+	}))
+	defer ts.Close()
+	r := &Request{Targets: []string{"web01.cpu", "sumSeries(a,b)"}, CSV: true}
+	resp, err := r.Query(ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "csv" || tz != "UTC" {
+		t.Errorf("expected format csv and tz UTC, got %q %q", format, tz)
+	}
+	expected := Response{
+		{Target: "web01.cpu", Datapoints: []DataPoint{{"1.5", "100"}, {"", "160"}}},
+		{Target: "sumSeries(a,b)", Datapoints: []DataPoint{{"3", "100"}}},
+	}
+	if !reflect.DeepEqual(resp, expected) {
+		t.Errorf("expected %v, got %v", expected, resp)
+	}
+}
+
+func TestQueryParams(t *testing.T) {
+	var host string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.URL.Query().Get("template[host]")
+		if r.URL.Query().Get("noNullPoints") != "true" {
+			t.Error("expected noNullPoints=true")
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer ts.Close()
+	r := &Request{Targets: []string{"template($host.cpu)"}}
+	key := r.CacheKey()
+	r.Template = map[string]string{"host": "web01"}
+	r.NoNullPoints = true
+	if _, err := r.Query(ts.URL, nil); err != nil {
+		t.Fatal(err)
+	}
+	if host != "web01" {
+		t.Errorf("expected template[host] web01, got %q", host)
+	}
+	if r.CacheKey() == key {
+		t.Error("expected the template and noNullPoints to change the cache key")
+	}
+}
+
+func TestQueryHeader(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ua := r.Header.Get("User-Agent"); ua != "bosun-test" {
+			t.Errorf("expected User-Agent bosun-test, got %q", ua)
+		}
+		if origin := r.Header.Get("X-Bosun-Origin"); origin != "alert" {
+			t.Errorf("expected X-Bosun-Origin alert, got %q", origin)
+		}
+		if token := r.Header.Get("X-Token"); token != "secret" {
+			t.Errorf("expected the header of the host to be kept, got X-Token %q", token)
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer ts.Close()
+	hostHeader := http.Header{"X-Token": {"secret"}, "User-Agent": {"other"}}
+	r := &Request{Targets: []string{"web01.cpu"}}
+	key := r.CacheKey()
+	r.Header = http.Header{"User-Agent": {"bosun-test"}, "X-Bosun-Origin": {"alert"}}
+	if _, err := r.Query(ts.URL, hostHeader); err != nil {
+		t.Fatal(err)
+	}
+	if hostHeader.Get("User-Agent") != "other" {
+		t.Error("the header of the host was changed")
+	}
+	if r.CacheKey() != key {
+		t.Error("expected the header not to change the cache key")
+	}
+}
+
+func TestQueryBytes(t *testing.T) {
+	body := `[{"target": "web01.cpu", "datapoints": [[1, 100], [2, 160]]}]`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer ts.Close()
+	r := &Request{Targets: []string{"web01.cpu"}}
+	for i := 1; i <= 2; i++ {
+		if _, err := r.Query(ts.URL, nil); err != nil {
+			t.Fatal(err)
+		}
+		if r.Bytes != int64(i*len(body)) {
+			t.Errorf("expected %d bytes after %d queries, got %d", i*len(body), i, r.Bytes)
+		}
+	}
+}
+
+func TestQueryConsolidateBy(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if target := r.URL.Query().Get("target"); target != "consolidateBy(web*.cpu,'max')" {
+			t.Errorf("unexpected target %q", target)
+		}
+		w.Write([]byte(`[{"target": "consolidateBy(web01.cpu,\"max\")", "datapoints": [[1, 100]]}]`))
+	}))
+	defer ts.Close()
+	r := &Request{Targets: []string{"web*.cpu"}}
+	key := r.CacheKey()
+	r.ConsolidateBy = "max"
+	resp, err := r.Query(ts.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != 1 || resp[0].Target != "web01.cpu" {
+		t.Errorf("expected the consolidateBy to be removed from the target, got %v", resp)
+	}
+	if r.CacheKey() == key {
+		t.Error("expected consolidateBy to change the cache key")
+	}
+}
+
+func TestQueryBasicAuth(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "bosun" || password != "secret" {
+			t.Errorf("unexpected credentials %q %q %v", user, password, ok)
+		}
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer ts.Close()
+	r := &Request{Targets: []string{"web01.cpu"}}
+	host := strings.Replace(ts.URL, "http://", "http://bosun:secret@", 1)
+	_, err := r.Query(host, nil)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if strings.Contains(err.Error(), "secret") || strings.Contains(r.URL.String(), "secret") {
+		t.Errorf("credentials leaked into the request URL %v or error %v", r.URL, err)
+	}
+	if rerr, ok := err.(*RequestError); !ok || rerr.StatusCode != http.StatusForbidden {
+		t.Errorf("expected a RequestError with status 403, got %#v", err)
+	}
+}
+
+func TestNormalizeTarget(t *testing.T) {
+	for target, expected := range map[string]string{
+		"sumSeries(a.b, c.d)":                 "sumSeries(a.b,c.d)",
+		" sumSeries ( a.b ,\tc.d ) ":          "sumSeries(a.b,c.d)",
+		`alias(a.b, "x , y" )`:                `alias(a.b,"x , y")`,
+		`alias(a.b, 'it\'s (b) ')`:            `alias(a.b,'it\'s (b) ')`,
+		"a.{b,c}.d":                           "a.{b,c}.d",
+		"seriesByTag('name=a b', 'dc = ny' )": "seriesByTag('name=a b','dc = ny')",
+	} {
+		if got := normalizeTarget(target); got != expected {
+			t.Errorf("%q: expected %q, got %q", target, expected, got)
+		}
+	}
+	a := &Request{Targets: []string{"sumSeries(a.*, b.*)"}}
+	b := &Request{Targets: []string{"sumSeries(a.*,b.*)"}}
+	c := &Request{Targets: []string{"sumSeries(b.*,a.*)"}}
+	if a.CacheKey() != b.CacheKey() {
+		t.Errorf("expected targets differing in whitespace to share a cache key")
+	}
+	if a.CacheKey() == c.CacheKey() {
+		t.Errorf("expected targets with different argument order to have different cache keys")
+	}
+}
+
+func TestQueryUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "graphite")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "graphite.sock")
+	l, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/render/" {
+			t.Errorf("unexpected path %q", r.URL.Path)
+		}
+		w.Write([]byte(`[{"target": "web01.cpu", "datapoints": [[1, 900]]}]`))
+	}))
+	ts.Listener = l
+	ts.Start()
+	defer ts.Close()
+	r := &Request{Targets: []string{"web01.cpu"}}
+	resp, err := r.Query("unix://"+socket, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp) != 1 || resp[0].Target != "web01.cpu" {
+		t.Errorf("unexpected response %v", resp)
+	}
+}
+
+func TestPaths(t *testing.T) {
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+		w.Write([]byte(`[]`))
+	}))
+	defer ts.Close()
+	h := HostHeader{Host: ts.URL + "/graphite/render", Paths: Paths{Render: "/api/v1/render"}}
+	if _, err := h.Query(&Request{Targets: []string{"web01.cpu"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := h.Find(context.Background(), &FindRequest{Query: "web01.*"}); err != nil {
+		t.Fatal(err)
+	}
+	h.Paths.Prefix = "/api/v1"
+	if _, err := h.Find(context.Background(), &FindRequest{Query: "web01.*"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"/api/v1/render", "/graphite/metrics/find/", "/api/v1/metrics/find/"}
+	if !reflect.DeepEqual(paths, expected) {
+		t.Errorf("expected paths %v, got %v", expected, paths)
+	}
+}
+
+func TestExpand(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/metrics/expand/" || r.URL.Query().Get("query") != "web*.cpu" || r.URL.Query().Get("leavesOnly") != "1" {
+			t.Errorf("unexpected request %v", r.URL)
+		}
+		w.Write([]byte(`{"results": ["web01.cpu", "web02.cpu"]}`))
+	}))
+	defer ts.Close()
+	paths, err := Expand(context.Background(), Host(ts.URL), &ExpandRequest{Query: "web*.cpu"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(paths, []string{"web01.cpu", "web02.cpu"}) {
+		t.Errorf("unexpected paths %v", paths)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/events/get_data" {
+			t.Errorf("unexpected path %q", r.URL.Path)
+		}
+		q := r.URL.Query()
+		if q.Get("from") != "100" || q.Get("until") != "200" || q.Get("tags") != "deploy web" {
+			t.Errorf("unexpected query %v", q)
+		}
+		w.Write([]byte(`[
+			{"id": 1, "when": 150.0, "what": "new", "data": "", "tags": ["deploy", "web"]},
+			{"id": 2, "when": 120, "what": "old", "data": "", "tags": "deploy web"}
+		]`))
+	}))
+	defer ts.Close()
+	start, end := time.Unix(100, 0), time.Unix(200, 0)
+	events, err := Events(context.Background(), Host(ts.URL), &EventsRequest{Start: &start, End: &end, Tags: []string{"deploy", "web"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].When != 150 {
+		t.Fatalf("unexpected events %v", events)
+	}
+	for _, ev := range events {
+		if !reflect.DeepEqual(ev.Tags, EventTags{"deploy", "web"}) {
+			t.Errorf("unexpected tags %q of event %d", ev.Tags, ev.ID)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	var path string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		if q := r.URL.Query().Get("query"); q != "web*.cpu" {
+			t.Errorf("unexpected query %q", q)
+		}
+		w.Write([]byte(`[{"id": "web01.cpu", "text": "cpu", "leaf": 1, "expandable": 0}]`))
+	}))
+	defer ts.Close()
+	for host, expected := range map[string]string{
+		ts.URL:                      "/metrics/find/",
+		ts.URL + "/graphite/render": "/graphite/metrics/find/",
+	} {
+		r := &FindRequest{Query: "web*.cpu"}
+		metrics, err := Host(host).Find(context.Background(), r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if path != expected {
+			t.Errorf("%s: expected path %s, got %s", host, expected, path)
+		}
+		if len(metrics) != 1 || metrics[0].ID != "web01.cpu" || metrics[0].Leaf != 1 {
+			t.Errorf("%s: unexpected metrics %v", host, metrics)
+		}
+	}
+}